@@ -13,245 +13,3499 @@
 package main
 
 import (
+    "bytes"
+    "compress/gzip"
+    "container/heap"
     "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/binary"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
+    "io"
     "log"
+    "math"
+    "mime"
+    "net"
     "net/http"
+    "net/http/pprof"
+    "net/url"
     "os"
+    "os/exec"
     "os/signal"
+    "path"
+    "path/filepath"
+    "reflect"
+    "runtime/debug"
+    "sort"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "syscall"
     "time"
 )
 
 const version = "1.0.0"
 
-// Todo represents a task.
+// now is the clock used for timestamps and request timing. Tests can swap it
+// for a fixed clock.
+var now = time.Now
+
+// maxBatchIDs caps how many ids GET /todos?ids= may request at once.
+const maxBatchIDs = 100
+
+// Limits for GET /todos/recent?n=.
+const (
+    defaultRecent = 10
+    maxRecent     = 100
+)
+
+// omitEmpty drops empty optional fields from JSON responses; set once from
+// -omit-empty at startup.
+var omitEmpty bool
+
+// logLevel is "info" or "debug", set once from -log-level at startup.
+var logLevel = "info"
+
+// startTime is when the process started serving, set at the top of main.
+var startTime time.Time
+
+// maxIDLen bounds the id path segment; an int64 has at most 19 digits.
+const maxIDLen = 19
+
+// Todo represents a task. Its struct tags describe the internal record form
+// used by store dumps; responses go through todoView via MarshalJSON.
 type Todo struct {
-    ID        int    `json:"id"`
-    Title     string `json:"title"`
-    Completed bool   `json:"completed"`
+    ID        int       `json:"id"`
+    Title     string    `json:"title"`
+    Completed bool      `json:"completed"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+    // CompletedAt is set when Completed flips to true and cleared when it
+    // flips back.
+    CompletedAt *time.Time `json:"completed_at,omitempty"`
+    Version     int        `json:"version"`
+    // UUID replaces ID on the wire when the store runs with -id-type=uuid.
+    // ID stays the internal key either way.
+    UUID string `json:"uuid,omitempty"`
+}
+
+// todoView is the wire form of a Todo.
+type todoView struct {
+    ID          interface{} `json:"id"`
+    Title       string      `json:"title"`
+    Completed   bool        `json:"completed"`
+    CreatedAt   jsonTime    `json:"created_at"`
+    UpdatedAt   jsonTime    `json:"updated_at"`
+    CompletedAt *jsonTime   `json:"completed_at"`
+    Version     int         `json:"version"`
+}
+
+func (t Todo) view() todoView {
+    v := todoView{
+        ID:        t.ID,
+        Title:     t.Title,
+        Completed: t.Completed,
+        CreatedAt: jsonTime(t.CreatedAt),
+        UpdatedAt: jsonTime(t.UpdatedAt),
+        Version:   t.Version,
+    }
+    if t.UUID != "" {
+        v.ID = t.UUID
+    }
+    if idPrefix != "" {
+        v.ID = fmt.Sprintf("%s%v", idPrefix, v.ID)
+    }
+    if t.CompletedAt != nil {
+        done := jsonTime(*t.CompletedAt)
+        v.CompletedAt = &done
+    }
+    return v
+}
+
+// idPrefix is prepended to every id on the wire, e.g. "todo_" for
+// "todo_42", and stripped again when ids are parsed. Set from -id-prefix.
+var idPrefix string
+
+// jsonNaming selects the response field naming, "snake" (the default) or
+// "camel". Set from -json-naming.
+var jsonNaming = "snake"
+
+// wireName renders a snake_case field name in the configured naming.
+func wireName(name string) string {
+    if jsonNaming != "camel" {
+        return name
+    }
+    parts := strings.Split(name, "_")
+    for i := 1; i < len(parts); i++ {
+        if parts[i] != "" {
+            parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+        }
+    }
+    return strings.Join(parts, "")
+}
+
+// fieldName maps a field name as a client may send it, snake_case or
+// camelCase, to the snake_case name used internally.
+func fieldName(name string) string {
+    var b strings.Builder
+    for _, c := range name {
+        if c >= 'A' && c <= 'Z' {
+            b.WriteByte('_')
+            c += 'a' - 'A'
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// timeFormat selects how jsonTime values are rendered: rfc3339, rfc3339nano,
+// unix or unixmilli. It is set once from -time-format at startup.
+var timeFormat = "rfc3339"
+
+// jsonTime is a time.Time marshaled according to timeFormat.
+type jsonTime time.Time
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+    tt := time.Time(t)
+    switch timeFormat {
+    case "unix":
+        return strconv.AppendInt(nil, tt.Unix(), 10), nil
+    case "unixmilli":
+        return strconv.AppendInt(nil, tt.UnixMilli(), 10), nil
+    case "rfc3339nano":
+        return json.Marshal(tt.Format(time.RFC3339Nano))
+    default:
+        return json.Marshal(tt.Format(time.RFC3339))
+    }
+}
+
+// updateResult is the response to an update: the todo plus the JSON names of
+// the fields the update actually modified.
+type updateResult struct {
+    todoView
+    Changed []string `json:"changed"`
+}
+
+// MarshalJSON renders the todo through todoView.
+func (t Todo) MarshalJSON() ([]byte, error) {
+    return json.Marshal(t.view())
 }
 
 // Store holds todos in memory.
 type Store struct {
     sync.RWMutex
-    todos map[int]*Todo
-    next  int
+    todos  map[int]*Todo
+    next   int
+    byUUID map[string]int // nil unless ids are UUIDs
+    // lastModified is when the collection last changed, for the list ETag.
+    lastModified time.Time
+
+    // Operations slower than slowThreshold are logged and counted; zero
+    // disables the check.
+    slowThreshold time.Duration
+    slowOps       atomic.Int64
+}
+
+// observe logs and counts op if it took longer than the slow threshold.
+// Call it as defer s.observe(op, id, now()) before taking the lock, so lock
+// waits count too; id 0 means the operation is not about one todo.
+func (s *Store) observe(op string, id int, start time.Time) {
+    if s.slowThreshold <= 0 {
+        return
+    }
+    d := now().Sub(start)
+    if d < s.slowThreshold {
+        return
+    }
+    s.slowOps.Add(1)
+    if id != 0 {
+        log.Printf("🐢 Slow store %s id=%d took %v", op, id, d)
+    } else {
+        log.Printf("🐢 Slow store %s took %v", op, d)
+    }
+}
+
+// NewStore initializes an empty store handing out ids of the given type,
+// "int" or "uuid". lastModified starts at creation, not the zero time, whose
+// UnixNano is out of range and would garble the list ETag.
+func NewStore(idType string) *Store {
+    s := &Store{todos: make(map[int]*Todo), next: 1, lastModified: now()}
+    if idType == "uuid" {
+        s.byUUID = make(map[string]int)
+    }
+    return s
 }
 
-// NewStore initializes an empty store.
-func NewStore() *Store {
-    return &Store{todos: make(map[int]*Todo), next: 1}
+// ParseID resolves an id path segment to the internal id. Segments that are
+// well-formed but unknown resolve to 0, which never matches a todo. The
+// -id-prefix is optional on input, so bare ids keep working.
+func (s *Store) ParseID(seg string) (int, bool) {
+    seg = strings.TrimPrefix(seg, idPrefix)
+    if s.byUUID == nil {
+        return parseID(seg)
+    }
+    seg = strings.ToLower(seg)
+    if !isUUID(seg) {
+        return 0, false
+    }
+    s.RLock()
+    defer s.RUnlock()
+    return s.byUUID[seg], true
 }
 
-func (s *Store) List() []*Todo {
+// List returns a copy of every todo. The slice is never nil, so an empty
+// store encodes as [] rather than null. Like the other read methods it takes
+// the request context so slower backends can abort once the client has gone
+// away.
+func (s *Store) List(ctx context.Context) ([]*Todo, error) {
+    defer s.observe("List", 0, now())
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     s.RLock()
     defer s.RUnlock()
+    copies := make([]Todo, 0, len(s.todos))
     list := make([]*Todo, 0, len(s.todos))
     for _, t := range s.todos {
-        list = append(list, t)
+        copies = append(copies, *t)
+        list = append(list, &copies[len(copies)-1])
+    }
+    return list, nil
+}
+
+// snapshot copies t so it can be read after the lock is released, while
+// writers keep updating the stored todo in place. Every method handing todos
+// out of the store returns snapshots. CompletedAt is shared: writers replace
+// that pointer but never write through it.
+func (t *Todo) snapshot() *Todo {
+    c := *t
+    return &c
+}
+
+// ListETag returns a weak ETag for the collection built from when it last
+// changed and how many todos it holds, so no item has to be hashed. Take it
+// before List: a write in between then only makes the tag older than the
+// body, which costs a refetch but never serves a stale 304.
+func (s *Store) ListETag() string {
+    s.RLock()
+    defer s.RUnlock()
+    return fmt.Sprintf(`W/"list-%x-%d"`, s.lastModified.UnixNano(), len(s.todos))
+}
+
+// todoRecord is a Todo without its MarshalJSON, so it encodes with the
+// internal id, UUID and full-precision timestamps.
+type todoRecord Todo
+
+// storeDump is the file format written by Dump and read by Load.
+type storeDump struct {
+    Next  int          `json:"next"`
+    Todos []todoRecord `json:"todos"`
+}
+
+// Dump writes every todo to path. It writes a temp file in the same
+// directory and renames it into place, so a crash never leaves a torn file.
+func (s *Store) Dump(path string) (int, error) {
+    s.RLock()
+    d := storeDump{Next: s.next, Todos: make([]todoRecord, 0, len(s.todos))}
+    for _, t := range s.todos {
+        d.Todos = append(d.Todos, todoRecord(*t))
     }
-    return list
+    s.RUnlock()
+    sort.Slice(d.Todos, func(i, j int) bool { return d.Todos[i].ID < d.Todos[j].ID })
+
+    f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(f.Name())
+    if err := json.NewEncoder(f).Encode(d); err != nil {
+        f.Close()
+        return 0, err
+    }
+    if err := f.Close(); err != nil {
+        return 0, err
+    }
+    return len(d.Todos), os.Rename(f.Name(), path)
+}
+
+// Load replaces the store's contents with a file written by Dump. Todos
+// dumped without a UUID get one when the store hands out UUIDs.
+func (s *Store) Load(path string) (int, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return 0, err
+    }
+    var d storeDump
+    if err := json.Unmarshal(data, &d); err != nil {
+        return 0, fmt.Errorf("%s: %w", path, err)
+    }
+    s.Lock()
+    defer s.Unlock()
+    s.todos = make(map[int]*Todo, len(d.Todos))
+    if s.byUUID != nil {
+        s.byUUID = make(map[string]int, len(d.Todos))
+    }
+    s.next = d.Next
+    s.lastModified = now()
+    for _, rec := range d.Todos {
+        t := Todo(rec)
+        if s.byUUID != nil {
+            if t.UUID == "" {
+                t.UUID = newUUID()
+            }
+            s.byUUID[t.UUID] = t.ID
+        }
+        s.todos[t.ID] = &t
+        if t.ID >= s.next {
+            s.next = t.ID + 1
+        }
+    }
+    return len(s.todos), nil
+}
+
+// GetMany looks up several todos under one read lock and returns snapshots.
+// The result is aligned with ids, with nil for each id that does not exist.
+func (s *Store) GetMany(ids []int) []*Todo {
+    defer s.observe("GetMany", 0, now())
+    s.RLock()
+    defer s.RUnlock()
+    found := make([]*Todo, len(ids))
+    for i, id := range ids {
+        if t, ok := s.todos[id]; ok {
+            found[i] = t.snapshot()
+        }
+    }
+    return found
+}
+
+// Name and Check make the store a HealthChecker. The in-memory store is
+// always available.
+func (s *Store) Name() string { return "store" }
+
+func (s *Store) Check(ctx context.Context) error { return ctx.Err() }
+
+// Grouped splits snapshots of the todos by completion in a single pass under
+// the read lock.
+func (s *Store) Grouped(ctx context.Context) (open, completed []*Todo, err error) {
+    defer s.observe("Grouped", 0, now())
+    if err := ctx.Err(); err != nil {
+        return nil, nil, err
+    }
+    s.RLock()
+    defer s.RUnlock()
+    open, completed = []*Todo{}, []*Todo{}
+    for _, t := range s.todos {
+        if t.Completed {
+            completed = append(completed, t.snapshot())
+        } else {
+            open = append(open, t.snapshot())
+        }
+    }
+    return open, completed, nil
+}
+
+// Recent returns the n most recently updated todos, newest first. It keeps a
+// min-heap of the n best seen so far instead of sorting the whole store.
+func (s *Store) Recent(ctx context.Context, n int) ([]*Todo, error) {
+    defer s.observe("Recent", 0, now())
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    s.RLock()
+    defer s.RUnlock()
+    h := make(byUpdatedAt, 0, n)
+    for _, t := range s.todos {
+        if len(h) < n {
+            heap.Push(&h, t)
+        } else if len(h) > 0 && t.UpdatedAt.After(h[0].UpdatedAt) {
+            h[0] = t
+            heap.Fix(&h, 0)
+        }
+    }
+    recent := make([]*Todo, len(h))
+    for i := len(h) - 1; i >= 0; i-- {
+        recent[i] = heap.Pop(&h).(*Todo).snapshot()
+    }
+    return recent, nil
+}
+
+// Oldest returns the todo with the earliest created_at, ties going to the
+// lower id. ok is false when the store is empty.
+func (s *Store) Oldest(ctx context.Context) (*Todo, bool, error) {
+    defer s.observe("Oldest", 0, now())
+    return s.scan(ctx, func(a, b *Todo) bool { return a.CreatedAt.Before(b.CreatedAt) })
+}
+
+// Newest returns the todo with the latest created_at, ties going to the
+// lower id. ok is false when the store is empty.
+func (s *Store) Newest(ctx context.Context) (*Todo, bool, error) {
+    defer s.observe("Newest", 0, now())
+    return s.scan(ctx, func(a, b *Todo) bool { return a.CreatedAt.After(b.CreatedAt) })
+}
+
+// scan finds the todo that comes first under better in one O(n) pass.
+func (s *Store) scan(ctx context.Context, better func(a, b *Todo) bool) (*Todo, bool, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, false, err
+    }
+    s.RLock()
+    defer s.RUnlock()
+    var best *Todo
+    for _, t := range s.todos {
+        if best == nil || better(t, best) || (!better(best, t) && t.ID < best.ID) {
+            best = t
+        }
+    }
+    if best == nil {
+        return nil, false, nil
+    }
+    return best.snapshot(), true, nil
+}
+
+// byUpdatedAt is a min-heap of todos keyed on UpdatedAt.
+type byUpdatedAt []*Todo
+
+func (h byUpdatedAt) Len() int            { return len(h) }
+func (h byUpdatedAt) Less(i, j int) bool  { return h[i].UpdatedAt.Before(h[j].UpdatedAt) }
+func (h byUpdatedAt) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *byUpdatedAt) Push(x interface{}) { *h = append(*h, x.(*Todo)) }
+func (h *byUpdatedAt) Pop() interface{} {
+    old := *h
+    t := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return t
 }
 
-func (s *Store) Create(title string) *Todo {
+func (s *Store) Create(title string, completed bool) *Todo {
+    defer s.observe("Create", 0, now())
     s.Lock()
     defer s.Unlock()
-    t := &Todo{ID: s.next, Title: title}
+    ts := now()
+    t := &Todo{ID: s.next, Title: title, Completed: completed, CreatedAt: ts, UpdatedAt: ts, Version: 1}
+    if completed {
+        t.CompletedAt = &ts
+    }
+    if s.byUUID != nil {
+        t.UUID = newUUID()
+        s.byUUID[t.UUID] = t.ID
+    }
     s.todos[s.next] = t
     s.next++
-    return t
+    s.lastModified = ts
+    return t.snapshot()
 }
 
 func (s *Store) Get(id int) (*Todo, bool) {
+    defer s.observe("Get", id, now())
     s.RLock()
     defer s.RUnlock()
     t, ok := s.todos[id]
-    return t, ok
+    if !ok {
+        return nil, false
+    }
+    return t.snapshot(), true
 }
 
-func (s *Store) Update(id int, title string, completed bool) (*Todo, bool) {
+// Update replaces the todo's content and reports which fields changed.
+func (s *Store) Update(id int, title string, completed bool) (*Todo, []string, bool) {
+    defer s.observe("Update", id, now())
     s.Lock()
     defer s.Unlock()
     t, ok := s.todos[id]
     if !ok {
-        return nil, false
+        return nil, nil, false
+    }
+    changed := s.apply(t, title, completed)
+    return t.snapshot(), changed, true
+}
+
+// apply sets t's content, bumps its version and reports which fields
+// changed. The caller holds the write lock.
+func (s *Store) apply(t *Todo, title string, completed bool) []string {
+    before := *t
+    ts := now()
+    switch {
+    case completed && !t.Completed:
+        t.CompletedAt = &ts
+    case !completed:
+        t.CompletedAt = nil
     }
     t.Title = title
     t.Completed = completed
-    return t, true
+    t.UpdatedAt = ts
+    t.Version++
+    s.lastModified = ts
+    return changedFields(&before, t)
+}
+
+// Patch applies validated JSON Patch operations to the todo's wire document
+// under one write lock, so test operations and the changes they guard are
+// atomic. A patch made only of tests leaves the todo, and its version,
+// untouched.
+func (s *Store) Patch(id int, ops []patchOp) (*Todo, []string, error) {
+    defer s.observe("Patch", id, now())
+    s.Lock()
+    defer s.Unlock()
+    t, ok := s.todos[id]
+    if !ok {
+        return nil, nil, errTodoNotFound
+    }
+    raw, err := json.Marshal(t)
+    if err != nil {
+        return nil, nil, err
+    }
+    var doc map[string]interface{}
+    if err := json.Unmarshal(raw, &doc); err != nil {
+        return nil, nil, err
+    }
+    mutated := false
+    for i, op := range ops {
+        if op.Op == "test" {
+            if !reflect.DeepEqual(doc[op.member], op.value) {
+                return nil, nil, fmt.Errorf("operation %d: %s: %w", i, op.Path, errPatchTest)
+            }
+            continue
+        }
+        doc[op.member] = op.value
+        mutated = true
+    }
+    if !mutated {
+        return t.snapshot(), []string{}, nil
+    }
+    changed := s.apply(t, doc["title"].(string), doc["completed"].(bool))
+    return t.snapshot(), changed, nil
+}
+
+// patchOp is one RFC 6902 JSON Patch operation.
+type patchOp struct {
+    Op    string          `json:"op"`
+    Path  string          `json:"path"`
+    Value json.RawMessage `json:"value"`
+    // member and value are Path and Value once validated and decoded.
+    member string
+    value  interface{}
+}
+
+// patchMembers lists the members of a todo's wire document a patch may
+// address, and whether add or replace may change them. The rest are
+// managed by the server and can only be tested.
+var patchMembers = map[string]bool{
+    "title":        true,
+    "completed":    true,
+    "id":           false,
+    "created_at":   false,
+    "updated_at":   false,
+    "completed_at": false,
+    "version":      false,
+}
+
+var (
+    errTodoNotFound = errors.New("todo not found")
+    errPatchTest    = errors.New("test failed")
+    errPrecondition = errors.New("precondition failed")
+)
+
+// validatePatch checks a decoded JSON Patch document and decodes its
+// values. Only add, replace and test are supported: a todo has a fixed set
+// of members, so remove, move and copy cannot produce a valid todo, and add
+// on an existing member is a replace.
+func validatePatch(ops []patchOp) error {
+    for i := range ops {
+        op := &ops[i]
+        switch op.Op {
+        case "add", "replace", "test":
+        default:
+            return fmt.Errorf("operation %d: unsupported op %q", i, op.Op)
+        }
+        member, ok := strings.CutPrefix(op.Path, "/")
+        member = fieldName(member)
+        mutable, known := patchMembers[member]
+        if !ok || !known {
+            return fmt.Errorf("operation %d: unknown path %q", i, op.Path)
+        }
+        if op.Op != "test" && !mutable {
+            return fmt.Errorf("operation %d: path %q is read-only", i, op.Path)
+        }
+        if op.Value == nil {
+            return fmt.Errorf("operation %d: missing value", i)
+        }
+        if err := json.Unmarshal(op.Value, &op.value); err != nil {
+            return fmt.Errorf("operation %d: invalid value", i)
+        }
+        op.member = member
+        if op.Op == "test" {
+            continue
+        }
+        switch member {
+        case "title":
+            if v, ok := op.value.(string); !ok || strings.TrimSpace(v) == "" {
+                return fmt.Errorf("operation %d: /title must be a non-blank string", i)
+            }
+        case "completed":
+            if _, ok := op.value.(bool); !ok {
+                return fmt.Errorf("operation %d: /completed must be a boolean", i)
+            }
+        }
+    }
+    return nil
+}
+
+// todoSchema describes the validation rules in effect for this server,
+// built from the live config so form UIs can mirror them exactly.
+func todoSchema(cfg *Config) map[string]interface{} {
+    // Ids are JSON numbers only when they are plain ints; a prefix or a
+    // UUID makes them strings.
+    id := map[string]interface{}{"type": "integer"}
+    if cfg.IDType == "uuid" || cfg.IDPrefix != "" {
+        id = map[string]interface{}{"type": "string", "prefix": cfg.IDPrefix}
+        if cfg.IDType == "uuid" {
+            id["format"] = "uuid"
+        }
+    }
+    var readOnly, sorts []string
+    for member, mutable := range patchMembers {
+        if !mutable {
+            readOnly = append(readOnly, wireName(member))
+        }
+    }
+    for field := range sortFields {
+        sorts = append(sorts, wireName(field))
+    }
+    sort.Strings(readOnly)
+    sort.Strings(sorts)
+    return map[string]interface{}{
+        "fields": map[string]interface{}{
+            "title":     map[string]interface{}{"type": "string", "required": true, "blank_allowed": false},
+            "completed": map[string]interface{}{"type": "boolean", "required": false, "default": false},
+        },
+        "read_only_fields": readOnly,
+        "id":               id,
+        "max_body_bytes":   cfg.MaxBodyBytes,
+        "writable":         !cfg.ReadOnly,
+        "list": map[string]interface{}{
+            "page_default":     cfg.PageDefault,
+            "page_max":         cfg.PageMax,
+            "max_batch_ids":    maxBatchIDs,
+            "max_query_params": cfg.MaxQueryParams,
+            "sort_fields":      sorts,
+            "default_sort":     wireName(cfg.DefaultSort),
+        },
+    }
+}
+
+// changedFields lists the content fields that differ between two snapshots
+// of a todo, by their JSON names.
+func changedFields(before, after *Todo) []string {
+    changed := []string{}
+    if before.Title != after.Title {
+        changed = append(changed, "title")
+    }
+    if before.Completed != after.Completed {
+        changed = append(changed, "completed")
+    }
+    return changed
+}
+
+// Touch bumps UpdatedAt and Version without changing the todo's content.
+func (s *Store) Touch(id int) (*Todo, bool) {
+    defer s.observe("Touch", id, now())
+    s.Lock()
+    defer s.Unlock()
+    t, ok := s.todos[id]
+    if !ok {
+        return nil, false
+    }
+    t.UpdatedAt = now()
+    t.Version++
+    s.lastModified = t.UpdatedAt
+    return t.snapshot(), true
 }
 
 func (s *Store) Delete(id int) bool {
+    return s.DeleteIf(id, nil) == nil
+}
+
+// DeleteIf removes the todo if cond, when non-nil, accepts its current
+// state. Check and delete share one write lock, so the todo cannot change
+// in between. It returns errTodoNotFound or errPrecondition on refusal.
+func (s *Store) DeleteIf(id int, cond func(*Todo) bool) error {
+    defer s.observe("Delete", id, now())
     s.Lock()
     defer s.Unlock()
-    if _, ok := s.todos[id]; !ok {
-        return false
+    t, ok := s.todos[id]
+    if !ok {
+        return errTodoNotFound
+    }
+    if cond != nil && !cond(t) {
+        return errPrecondition
     }
     delete(s.todos, id)
-    return true
+    if s.byUUID != nil {
+        delete(s.byUUID, t.UUID)
+    }
+    s.lastModified = now()
+    return nil
 }
 
-// Metrics collects basic stats.
-type Metrics struct {
-    sync.Mutex
-    Requests   int `json:"requests"`
-    TotalTodos int `json:"total_todos"`
+// endpoint describes a route for the index served on GET /.
+type endpoint struct {
+    Method      string `json:"method"`
+    Path        string `json:"path"`
+    Description string `json:"description"`
 }
 
-func (m *Metrics) Inc() {
-    m.Lock()
-    m.Requests++
-    m.Unlock()
+var endpoints = []endpoint{
+    {"GET", "/healthz", "Health check"},
+    {"GET", "/version", "Server version"},
+    {"GET", "/readyz", "Readiness of every dependency (?verbose=true for details)"},
+    {"GET", "/metrics", "Request and todo counters"},
+    {"POST", "/metrics/reset", "Zero the windowed request counter"},
+    {"GET", "/debug/config", "Effective configuration, secrets redacted"},
+    {"GET", "/debug/conns", "Open connections per client IP"},
+    {"GET", "/debug/requests", "Recently captured requests"},
+    {"GET", "/debug/pprof/", "Go runtime profiles"},
+    {"GET", "/todos", "List all todos (?page=&per_page= for offset pagination, ?with_count=true for a total)"},
+    {"POST", "/todos", "Create a todo"},
+    {"GET", "/todos/schema", "Validation rules and limits currently in effect"},
+    {"GET", "/todos/grouped", "Todos grouped into open and completed"},
+    {"GET", "/todos/oldest", "The todo created first"},
+    {"GET", "/todos/newest", "The todo created last"},
+    {"GET", "/todos/recent", "Most recently updated todos (?n=, default 10, max 100)"},
+    {"GET", "/todos/{id}", "Get a single todo"},
+    {"PUT", "/todos/{id}", "Update a todo"},
+    {"PATCH", "/todos/{id}", "Apply a JSON Patch (application/json-patch+json)"},
+    {"DELETE", "/todos/{id}", "Delete a todo"},
+    {"POST", "/todos/{id}/touch", "Bump updated_at and version without changing content"},
 }
 
-func (m *Metrics) Snapshot(store *Store) map[string]int {
-    m.Lock()
-    defer m.Unlock()
-    store.RLock()
-    m.TotalTodos = len(store.todos)
-    store.RUnlock()
-    return map[string]int{"requests": m.Requests, "total_todos": m.TotalTodos}
+// servedEndpoints lists the endpoints mux routes somewhere other than its
+// catch-all, so routes moved to -admin-port or left disabled stay out of
+// the index.
+func servedEndpoints(mux *http.ServeMux) []endpoint {
+    out := []endpoint{}
+    for _, e := range endpoints {
+        r := &http.Request{Method: e.Method, URL: &url.URL{Path: strings.ReplaceAll(e.Path, "{id}", "1")}}
+        if _, pattern := mux.Handler(r); pattern != "" && pattern != "/" {
+            out = append(out, e)
+        }
+    }
+    return out
 }
 
-// statusWriter captures HTTP status code.
-type statusWriter struct {
-    http.ResponseWriter
-    status int
+// Page is the envelope returned by offset pagination.
+type Page struct {
+    Items      []*Todo `json:"items"`
+    Page       int     `json:"page"`
+    PerPage    int     `json:"per_page"`
+    Total      int     `json:"total"`
+    TotalPages int     `json:"total_pages"`
 }
 
-func (w *statusWriter) WriteHeader(code int) {
-    w.status = code
-    w.ResponseWriter.WriteHeader(code)
+// countedList answers GET /todos?with_count=true, and any unpaged list
+// that had to be truncated.
+type countedList struct {
+    Items     []*Todo `json:"items"`
+    Total     int     `json:"total"`
+    Truncated bool    `json:"truncated,omitempty"`
 }
 
-// withLogging logs method, path, status, duration.
-func withLogging(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        start := time.Now()
-        lw := &statusWriter{w, http.StatusOK}
-        next.ServeHTTP(lw, r)
-        log.Printf("%s %s %d %v", r.Method, r.URL.Path, lw.status, time.Since(start))
-    })
+// paginate slices the page requested by the page and per_page query
+// parameters out of already sorted todos. per_page defaults to perPage and is
+// capped at maxPerPage.
+func paginate(todos []*Todo, q url.Values, perPage, maxPerPage int) (*Page, error) {
+    p := &Page{Page: 1, PerPage: perPage, Total: len(todos)}
+    if v := q.Get("page"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("invalid page %q", v)
+        }
+        p.Page = n
+    }
+    if v := q.Get("per_page"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("invalid per_page %q", v)
+        }
+        p.PerPage = n
+    }
+    if p.PerPage > maxPerPage {
+        p.PerPage = maxPerPage
+    }
+    p.TotalPages = (p.Total + p.PerPage - 1) / p.PerPage
+    start := (p.Page - 1) * p.PerPage
+    if start > len(todos) {
+        start = len(todos)
+    }
+    end := start + p.PerPage
+    if end > len(todos) {
+        end = len(todos)
+    }
+    p.Items = todos[start:end]
+    return p, nil
 }
 
-// withMetrics increments request counter.
-func withMetrics(m *Metrics, next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        m.Inc()
-        next.ServeHTTP(w, r)
-    })
-}
+// ipNets is a flag.Value holding a comma-separated list of IPs and CIDRs.
+type ipNets []*net.IPNet
 
-func main() {
-    port := flag.Int("port", 8080, "server port")
-    flag.Parse()
+func (n *ipNets) String() string {
+    parts := make([]string, len(*n))
+    for i, ipn := range *n {
+        parts[i] = ipn.String()
+    }
+    return strings.Join(parts, ",")
+}
 
-    store := NewStore()
-    metrics := &Metrics{}
+// MarshalText renders the list as it was given on the command line.
+func (n ipNets) MarshalText() ([]byte, error) { return []byte(n.String()), nil }
 
-    mux := http.NewServeMux()
-    mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte("ok"))
-    })
-    mux.HandleFunc("/version", func(w http.ResponseWriter, _ *http.Request) {
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte(version))
-    })
-    mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
-        js, _ := json.MarshalIndent(metrics.Snapshot(store), "", "  ")
-        w.Header().Set("Content-Type", "application/json")
-        w.Write(js)
-    })
-    mux.HandleFunc("/todos", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case http.MethodGet:
-            respondJSON(w, store.List(), http.StatusOK)
-        case http.MethodPost:
-            var payload struct{ Title string }
-            if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || strings.TrimSpace(payload.Title) == "" {
-                http.Error(w, "invalid payload", http.StatusBadRequest)
-                return
+func (n *ipNets) Set(v string) error {
+    for _, part := range strings.Split(v, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        if !strings.Contains(part, "/") {
+            ip := net.ParseIP(part)
+            if ip == nil {
+                return fmt.Errorf("invalid IP %q", part)
             }
-            t := store.Create(payload.Title)
-            respondJSON(w, t, http.StatusCreated)
-        default:
-            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            bits := 128
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            *n = append(*n, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
         }
-    })
-    mux.HandleFunc("/todos/", func(w http.ResponseWriter, r *http.Request) {
-        idStr := strings.TrimPrefix(r.URL.Path, "/todos/")
-        id, err := strconv.Atoi(idStr)
+        _, ipn, err := net.ParseCIDR(part)
         if err != nil {
-            http.Error(w, "invalid id", http.StatusBadRequest)
-            return
+            return err
         }
-        switch r.Method {
-        case http.MethodGet:
-            if t, ok := store.Get(id); ok {
-                respondJSON(w, t, http.StatusOK)
-            } else {
-                http.Error(w, "not found", http.StatusNotFound)
+        *n = append(*n, ipn)
+    }
+    return nil
+}
+
+// Contains reports whether ip falls in any of the networks.
+func (n ipNets) Contains(ip net.IP) bool {
+    for _, ipn := range n {
+        if ipn.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// filterCompleted keeps the todos completed within the RFC 3339 bounds
+// given by completed_from and completed_to, both inclusive. Without either
+// parameter todos are returned unchanged.
+func filterCompleted(todos []*Todo, q url.Values) ([]*Todo, error) {
+    if !q.Has("completed_from") && !q.Has("completed_to") {
+        return todos, nil
+    }
+    from, err := timeParam(q, "completed_from")
+    if err != nil {
+        return nil, err
+    }
+    to, err := timeParam(q, "completed_to")
+    if err != nil {
+        return nil, err
+    }
+    if !from.IsZero() && !to.IsZero() && to.Before(from) {
+        return nil, fmt.Errorf("completed_to is before completed_from")
+    }
+    kept := make([]*Todo, 0, len(todos))
+    for _, t := range todos {
+        if t.CompletedAt == nil || t.CompletedAt.Before(from) || !to.IsZero() && t.CompletedAt.After(to) {
+            continue
+        }
+        kept = append(kept, t)
+    }
+    return kept, nil
+}
+
+// timeParam parses an optional RFC 3339 query parameter; absent parameters
+// yield the zero time.
+func timeParam(q url.Values, name string) (time.Time, error) {
+    v := q.Get(name)
+    if v == "" {
+        return time.Time{}, nil
+    }
+    t, err := time.Parse(time.RFC3339, v)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid %s %q: want RFC 3339", name, v)
+    }
+    return t, nil
+}
+
+// sortFields are the fields GET /todos can be ordered by with ?sort=.
+var sortFields = map[string]func(a, b *Todo) bool{
+    "id":         func(a, b *Todo) bool { return a.ID < b.ID },
+    "title":      func(a, b *Todo) bool { return a.Title < b.Title },
+    "created_at": func(a, b *Todo) bool { return a.CreatedAt.Before(b.CreatedAt) },
+    "updated_at": func(a, b *Todo) bool { return a.UpdatedAt.Before(b.UpdatedAt) },
+}
+
+// parseSort turns a sort spec, a field name optionally prefixed with - for
+// descending, into an ordering. Ties fall back to ascending id so the order
+// is always total and repeated calls list todos identically.
+func parseSort(spec string) (func(a, b *Todo) bool, error) {
+    field, desc := strings.CutPrefix(spec, "-")
+    cmp, ok := sortFields[fieldName(field)]
+    if !ok {
+        return nil, fmt.Errorf("invalid sort %q: want id, title, created_at or updated_at, optionally prefixed with -", spec)
+    }
+    return func(a, b *Todo) bool {
+        x, y := a, b
+        if desc {
+            x, y = b, a
+        }
+        if cmp(x, y) {
+            return true
+        }
+        if cmp(y, x) {
+            return false
+        }
+        return a.ID < b.ID
+    }, nil
+}
+
+// sortTodos orders todos in place by less.
+func sortTodos(todos []*Todo, less func(a, b *Todo) bool) {
+    sort.Slice(todos, func(i, j int) bool { return less(todos[i], todos[j]) })
+}
+
+// parseItemsRange parses the "first-last" or "first-" part of a
+// "Range: items=" header into zero-based inclusive bounds within total.
+func parseItemsRange(spec string, total int) (first, last int, ok bool) {
+    from, to, found := strings.Cut(strings.TrimSpace(spec), "-")
+    if !found {
+        return 0, 0, false
+    }
+    first, err := strconv.Atoi(from)
+    if err != nil || first < 0 || first >= total {
+        return 0, 0, false
+    }
+    last = total - 1
+    if to != "" {
+        n, err := strconv.Atoi(to)
+        if err != nil || n < first {
+            return 0, 0, false
+        }
+        if n < last {
+            last = n
+        }
+    }
+    return first, last, true
+}
+
+// headerPairs is a repeatable flag.Value of KEY=VALUE header requirements.
+type headerPairs [][2]string
+
+func (h *headerPairs) String() string {
+    parts := make([]string, len(*h))
+    for i, p := range *h {
+        parts[i] = p[0] + "=" + p[1]
+    }
+    return strings.Join(parts, ",")
+}
+
+// MarshalText renders the pairs as KEY=VALUE,...; redact them first when
+// showing them to anyone.
+func (h headerPairs) MarshalText() ([]byte, error) { return []byte(h.String()), nil }
+
+func (h *headerPairs) Set(v string) error {
+    key, value, ok := strings.Cut(v, "=")
+    if !ok || strings.TrimSpace(key) == "" {
+        return fmt.Errorf("want KEY=VALUE, got %q", v)
+    }
+    *h = append(*h, [2]string{http.CanonicalHeaderKey(strings.TrimSpace(key)), value})
+    return nil
+}
+
+// Config holds the server settings resolved from the command line.
+type Config struct {
+    Port            int
+    IDType          string
+    IDPrefix        string
+    MaxBodyBytes    int64
+    MaxHeaderBytes  int
+    MaxQueryParams  int
+    NoKeepAlives    bool
+    MaxConnsPerIP   int
+    ReuseAddr       bool
+    TimeFormat      string
+    LogLevel        string
+    RequestIDHeader string
+    OmitEmpty       bool
+    JSONNaming      string
+    ForceHTTPS      bool
+    RecoverPanics   bool
+    DebugErrors     bool
+    ReadOnly        bool
+    WriteRate       float64
+    WriteBurst      int
+    RequireHeaders  headerPairs
+    Pprof           bool
+    AdminPort       int
+    CaptureBodies   int
+    DebugConns      bool
+    DebugConfig     bool
+    PageDefault     int
+    PageMax         int
+    DefaultSort     string
+    DumpOnExit      string
+    DrainDelay      time.Duration
+    ReadTimeout     time.Duration
+    ReadHdrTimeout  time.Duration
+    ShutdownRetry   time.Duration
+    SlowStore       time.Duration
+    TrustedProxies  ipNets
+    Index           bool
+    SecurityHeaders bool
+    FrameOptions    string
+    ServerHeader    string
+    ServerTiming    bool
+}
+
+// defaultConfig returns the settings used when no flag overrides them; the
+// flags in main take their defaults from it.
+func defaultConfig() *Config {
+    return &Config{
+        Port:            8080,
+        IDType:          "int",
+        MaxBodyBytes:    1 << 20,
+        MaxHeaderBytes:  http.DefaultMaxHeaderBytes,
+        MaxQueryParams:  64,
+        JSONNaming:      "snake",
+        RequestIDHeader: "X-Request-ID",
+        TimeFormat:      "rfc3339",
+        RecoverPanics:   true,
+        PageDefault:     50,
+        PageMax:         500,
+        DefaultSort:     "id",
+        LogLevel:        "info",
+        ReadTimeout:     30 * time.Second,
+        ReadHdrTimeout:  10 * time.Second,
+        ShutdownRetry:   5 * time.Second,
+        WriteBurst:      10,
+        Index:           true,
+        FrameOptions:    "DENY",
+    }
+}
+
+// redacted stands in for secret config values wherever config is shown.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c that is safe to show operators: secret
+// values are replaced while their names stay, so it is still clear what is
+// configured. Every secret setting must be scrubbed here.
+func (c Config) Redacted() Config {
+    r := c
+    r.RequireHeaders = make(headerPairs, len(c.RequireHeaders))
+    for i, h := range c.RequireHeaders {
+        r.RequireHeaders[i] = [2]string{h[0], redacted}
+    }
+    return r
+}
+
+// MarshalJSON writes durations in flag syntax, "5s" rather than
+// nanoseconds, so the output can be pasted back onto the command line.
+func (c Config) MarshalJSON() ([]byte, error) {
+    type plain Config
+    return json.Marshal(struct {
+        plain
+        DrainDelay     string
+        ReadTimeout    string
+        ReadHdrTimeout string
+        ShutdownRetry  string
+        SlowStore      string
+    }{plain(c), c.DrainDelay.String(), c.ReadTimeout.String(), c.ReadHdrTimeout.String(), c.ShutdownRetry.String(), c.SlowStore.String()})
+}
+
+// Summary renders the effective config as one key=value log line: the
+// settings people ask about first, then the full redacted config as JSON.
+func (c Config) Summary() string {
+    admin := "off"
+    if c.AdminPort != 0 {
+        admin = fmt.Sprintf(":%d", c.AdminPort)
+    }
+    auth := "off"
+    if len(c.RequireHeaders) > 0 {
+        auth = "require-header"
+    }
+    writeLimit := "off"
+    if c.WriteRate > 0 {
+        writeLimit = fmt.Sprintf("%g/s,burst=%d", c.WriteRate, c.WriteBurst)
+    }
+    js, err := json.Marshal(c.Redacted())
+    if err != nil {
+        js = []byte(strconv.Quote(err.Error()))
+    }
+    return fmt.Sprintf("addr=:%d admin=%s backend=memory tls=off auth=%s write_limit=%s read_only=%t config=%s",
+        c.Port, admin, auth, writeLimit, c.ReadOnly, js)
+}
+
+// Validate rejects nonsensical settings so the server fails fast at startup
+// instead of misbehaving later.
+func (c *Config) Validate() error {
+    if c.Port < 1 || c.Port > 65535 {
+        return fmt.Errorf("port %d out of range 1-65535", c.Port)
+    }
+    if c.MaxBodyBytes < 1 {
+        return fmt.Errorf("max body bytes must be positive, got %d", c.MaxBodyBytes)
+    }
+    if c.MaxHeaderBytes < 1 {
+        return fmt.Errorf("max header bytes must be positive, got %d", c.MaxHeaderBytes)
+    }
+    if c.MaxConnsPerIP < 0 {
+        return fmt.Errorf("max conns per ip must be >= 0, got %d", c.MaxConnsPerIP)
+    }
+    if c.AdminPort != 0 && (c.AdminPort < 1 || c.AdminPort > 65535 || c.AdminPort == c.Port) {
+        return fmt.Errorf("admin port %d must be in range 1-65535 and differ from port %d", c.AdminPort, c.Port)
+    }
+    if c.ReadTimeout < 0 || c.ReadHdrTimeout < 0 {
+        return fmt.Errorf("read timeouts must be >= 0")
+    }
+    if c.DrainDelay < 0 || c.ShutdownRetry < 0 {
+        return fmt.Errorf("drain delay and shutdown retry-after must be >= 0")
+    }
+    if c.SlowStore < 0 {
+        return fmt.Errorf("slow store threshold must be >= 0, got %v", c.SlowStore)
+    }
+    if c.CaptureBodies < 0 || c.CaptureBodies > maxCaptureBodies {
+        return fmt.Errorf("capture bodies must be between 0 and %d, got %d", maxCaptureBodies, c.CaptureBodies)
+    }
+    if c.PageDefault < 1 || c.PageDefault > c.PageMax {
+        return fmt.Errorf("page default %d must be between 1 and page max %d", c.PageDefault, c.PageMax)
+    }
+    if _, err := parseSort(c.DefaultSort); err != nil {
+        return fmt.Errorf("default sort: %v", err)
+    }
+    if c.MaxQueryParams < 1 {
+        return fmt.Errorf("max query params must be positive, got %d", c.MaxQueryParams)
+    }
+    if c.DumpOnExit != "" {
+        dir := filepath.Dir(c.DumpOnExit)
+        if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+            return fmt.Errorf("dump file %q: directory does not exist", c.DumpOnExit)
+        }
+        // Dump writes a temp file there and renames it, so probe exactly
+        // that rather than trust permission bits.
+        f, err := os.CreateTemp(dir, filepath.Base(c.DumpOnExit)+".probe*")
+        if err != nil {
+            return fmt.Errorf("dump file %q: directory is not writable: %v", c.DumpOnExit, err)
+        }
+        f.Close()
+        os.Remove(f.Name())
+    }
+    if c.WriteRate < 0 {
+        return fmt.Errorf("write rate must be >= 0, got %g", c.WriteRate)
+    }
+    if c.WriteRate > 0 && c.WriteBurst < 1 {
+        return fmt.Errorf("write burst must be positive, got %d", c.WriteBurst)
+    }
+    if c.IDType != "int" && c.IDType != "uuid" {
+        return fmt.Errorf("id type %q must be int or uuid", c.IDType)
+    }
+    if strings.ContainsAny(c.IDPrefix, "/,?#% ") {
+        return fmt.Errorf("id prefix %q must not contain '/', ',', '?', '#', '%%' or spaces", c.IDPrefix)
+    }
+    if c.JSONNaming != "snake" && c.JSONNaming != "camel" {
+        return fmt.Errorf("json naming %q must be snake or camel", c.JSONNaming)
+    }
+    if c.LogLevel != "info" && c.LogLevel != "debug" {
+        return fmt.Errorf("log level %q must be info or debug", c.LogLevel)
+    }
+    if c.RequestIDHeader == "" {
+        return fmt.Errorf("request id header must not be empty")
+    }
+    switch c.TimeFormat {
+    case "rfc3339", "rfc3339nano", "unix", "unixmilli":
+    default:
+        return fmt.Errorf("time format %q must be rfc3339, rfc3339nano, unix or unixmilli", c.TimeFormat)
+    }
+    switch c.FrameOptions {
+    case "", "DENY", "SAMEORIGIN":
+    default:
+        return fmt.Errorf("frame options %q must be DENY, SAMEORIGIN or empty", c.FrameOptions)
+    }
+    return nil
+}
+
+// todoOverhead approximates the fixed memory cost of one stored todo: the
+// struct itself, its pointer and its map entry. store_bytes adds the
+// variable-length strings on top.
+const todoOverhead = 160
+
+// HealthChecker is a dependency whose availability /readyz reports.
+type HealthChecker interface {
+    Name() string
+    Check(ctx context.Context) error
+}
+
+// checkResult is one dependency's entry in a verbose /readyz response.
+type checkResult struct {
+    Status string `json:"status"`
+    Error  string `json:"error,omitempty"`
+}
+
+// checkHealth runs every checker and reports whether all passed.
+func checkHealth(ctx context.Context, checkers []HealthChecker) (bool, map[string]checkResult) {
+    ok := true
+    results := make(map[string]checkResult, len(checkers))
+    for _, c := range checkers {
+        if err := c.Check(ctx); err != nil {
+            ok = false
+            results[c.Name()] = checkResult{Status: "unavailable", Error: err.Error()}
+            continue
+        }
+        results[c.Name()] = checkResult{Status: "ok"}
+    }
+    return ok, results
+}
+
+// sizeBuckets are the upper bounds, in body bytes, of the response size
+// histogram; larger responses land in the last bucket.
+var sizeBuckets = [...]struct {
+    name  string
+    limit int
+}{
+    {"lt_1kb", 1 << 10},
+    {"1kb_10kb", 10 << 10},
+    {"10kb_100kb", 100 << 10},
+    {"gte_100kb", math.MaxInt},
+}
+
+// Metrics collects basic stats.
+type Metrics struct {
+    sync.Mutex
+    Requests   int `json:"requests"`
+    TotalTodos int `json:"total_todos"`
+    // LifetimeRequests counts every request since startup; Reset leaves it
+    // alone so windowed and cumulative views coexist.
+    LifetimeRequests int `json:"lifetime_requests"`
+
+    // Connection lifecycle, updated lock-free from ConnState.
+    connStates  sync.Map // net.Conn -> last http.ConnState
+    connsNew    atomic.Int64
+    connsActive atomic.Int64
+    connsIdle   atomic.Int64
+    connsClosed atomic.Int64
+    openConns   atomic.Int64
+    idleConns   atomic.Int64
+
+    // respSizes counts responses per sizeBuckets entry.
+    respSizes [len(sizeBuckets)]atomic.Int64
+
+    // window is a ring of per-second response counts covering the last
+    // errorWindow seconds, guarded by the embedded mutex.
+    window [errorWindow]secondBucket
+}
+
+// errorWindow is the length in seconds of the error_rate_1m window.
+const errorWindow = 60
+
+// secondBucket counts the responses finished during one wall-clock second.
+type secondBucket struct {
+    sec    int64
+    total  int
+    errors int
+}
+
+func (m *Metrics) Inc() {
+    m.Lock()
+    m.Requests++
+    m.LifetimeRequests++
+    m.Unlock()
+}
+
+// ObserveSize counts a response of n body bytes in its size bucket.
+func (m *Metrics) ObserveSize(n int) {
+    for i, b := range sizeBuckets {
+        if n < b.limit {
+            m.respSizes[i].Add(1)
+            return
+        }
+    }
+}
+
+// ObserveStatus records a finished response in the current second's bucket.
+// Only 5xx counts as an error: 4xx is the client's mistake, not a sign the
+// server is failing. A bucket left over from an earlier lap of the ring is
+// cleared before reuse.
+func (m *Metrics) ObserveStatus(status int) {
+    sec := now().Unix()
+    m.Lock()
+    b := &m.window[sec%errorWindow]
+    if b.sec != sec {
+        *b = secondBucket{sec: sec}
+    }
+    b.total++
+    if status >= 500 {
+        b.errors++
+    }
+    m.Unlock()
+}
+
+// errorRate is the share of responses in the last errorWindow seconds that
+// were errors, 0 when there were none. The caller holds the lock.
+func (m *Metrics) errorRate() float64 {
+    cutoff := now().Unix() - errorWindow
+    total, errs := 0, 0
+    for _, b := range m.window {
+        if b.sec > cutoff {
+            total += b.total
+            errs += b.errors
+        }
+    }
+    if total == 0 {
+        return 0
+    }
+    return float64(errs) / float64(total)
+}
+
+// Reset starts a new counting window for the resettable counters.
+func (m *Metrics) Reset() {
+    m.Lock()
+    m.Requests = 0
+    m.Unlock()
+}
+
+func (m *Metrics) Snapshot(store *Store) map[string]interface{} {
+    m.Lock()
+    defer m.Unlock()
+    store.RLock()
+    m.TotalTodos = len(store.todos)
+    storeBytes := 0
+    for _, t := range store.todos {
+        storeBytes += todoOverhead + len(t.Title) + len(t.UUID)
+    }
+    store.RUnlock()
+    sizes := make(map[string]int, len(sizeBuckets))
+    for i, b := range sizeBuckets {
+        sizes[b.name] = int(m.respSizes[i].Load())
+    }
+    return map[string]interface{}{
+        "started_at":         startTime.UTC().Format(time.RFC3339),
+        "uptime_seconds":     int(now().Sub(startTime).Seconds()),
+        "requests":           m.Requests,
+        "lifetime_requests":  m.LifetimeRequests,
+        "total_todos":        m.TotalTodos,
+        "store_bytes":        storeBytes,
+        "connections_new":    int(m.connsNew.Load()),
+        "connections_active": int(m.connsActive.Load()),
+        "connections_idle":   int(m.connsIdle.Load()),
+        "connections_closed": int(m.connsClosed.Load()),
+        "open_connections":   int(m.openConns.Load()),
+        "idle_connections":   int(m.idleConns.Load()),
+        "response_sizes":     sizes,
+        "slow_store_ops":     int(store.slowOps.Load()),
+        "error_rate_1m":      m.errorRate(),
+    }
+}
+
+// ConnState counts connection state transitions and keeps the open and idle
+// gauges. It is installed as http.Server.ConnState, which the server calls
+// concurrently from every connection.
+func (m *Metrics) ConnState(c net.Conn, state http.ConnState) {
+    if prev, ok := m.connStates.Load(c); ok && prev == http.StateIdle {
+        m.idleConns.Add(-1)
+    }
+    switch state {
+    case http.StateNew:
+        m.connsNew.Add(1)
+        m.openConns.Add(1)
+    case http.StateActive:
+        m.connsActive.Add(1)
+    case http.StateIdle:
+        m.connsIdle.Add(1)
+        m.idleConns.Add(1)
+    case http.StateClosed, http.StateHijacked:
+        if state == http.StateClosed {
+            m.connsClosed.Add(1)
+        }
+        m.openConns.Add(-1)
+        m.connStates.Delete(c)
+        return
+    }
+    m.connStates.Store(c, state)
+}
+
+// ConnLimiter counts open connections per client IP and, with a positive
+// limit, closes new connections from an IP that already holds that many.
+// Trusted proxies are counted but never refused, since many clients share
+// them.
+type ConnLimiter struct {
+    sync.Mutex
+    limit    int
+    trusted  ipNets
+    perIP    map[string]int
+    rejected int
+}
+
+// NewConnLimiter returns a limiter allowing limit connections per IP; zero
+// only counts.
+func NewConnLimiter(limit int, trusted ipNets) *ConnLimiter {
+    return &ConnLimiter{limit: limit, trusted: trusted, perIP: make(map[string]int)}
+}
+
+// ConnState tracks connections opening and closing. Chain it from
+// http.Server.ConnState. A refused connection is closed straight away and
+// the server then reports it closed like any other.
+func (l *ConnLimiter) ConnState(c net.Conn, state http.ConnState) {
+    if state != http.StateNew && state != http.StateClosed && state != http.StateHijacked {
+        return
+    }
+    host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+    if err != nil {
+        host = c.RemoteAddr().String()
+    }
+    l.Lock()
+    if state != http.StateNew {
+        if l.perIP[host]--; l.perIP[host] <= 0 {
+            delete(l.perIP, host)
+        }
+        l.Unlock()
+        return
+    }
+    l.perIP[host]++
+    refuse := l.limit > 0 && l.perIP[host] > l.limit && !l.trusted.Contains(net.ParseIP(host))
+    if refuse {
+        l.rejected++
+    }
+    l.Unlock()
+    if refuse {
+        c.Close()
+    }
+}
+
+// Snapshot reports the limit, refused connections and open connections per
+// IP for GET /debug/conns.
+func (l *ConnLimiter) Snapshot() map[string]interface{} {
+    l.Lock()
+    defer l.Unlock()
+    perIP := make(map[string]int, len(l.perIP))
+    for ip, n := range l.perIP {
+        perIP[ip] = n
+    }
+    return map[string]interface{}{
+        "limit":    l.limit,
+        "rejected": l.rejected,
+        "per_ip":   perIP,
+    }
+}
+
+// maxCapturedBody bounds how much of each request body the capture buffer keeps.
+const maxCapturedBody = 4096
+
+// maxCaptureBodies caps -capture-bodies, keeping the ring, allocated up
+// front, to a few megabytes of bodies.
+const maxCaptureBodies = 1000
+
+// capturedRequest is one entry in the request capture buffer.
+type capturedRequest struct {
+    Time   time.Time   `json:"time"`
+    Method string      `json:"method"`
+    Path   string      `json:"path"`
+    Header http.Header `json:"header"`
+    Body   string      `json:"body"`
+    Status int         `json:"status"`
+}
+
+// Capture is a fixed-size ring buffer of recent requests, kept for
+// debugging client reports.
+type Capture struct {
+    sync.Mutex
+    entries []capturedRequest
+    next    int
+    full    bool
+}
+
+// NewCapture returns a ring buffer holding the last size requests.
+func NewCapture(size int) *Capture {
+    return &Capture{entries: make([]capturedRequest, size)}
+}
+
+func (c *Capture) Add(e capturedRequest) {
+    c.Lock()
+    defer c.Unlock()
+    c.entries[c.next] = e
+    c.next = (c.next + 1) % len(c.entries)
+    if c.next == 0 {
+        c.full = true
+    }
+}
+
+// Recent returns the captured requests, newest first.
+func (c *Capture) Recent() []capturedRequest {
+    c.Lock()
+    defer c.Unlock()
+    n := c.next
+    if c.full {
+        n = len(c.entries)
+    }
+    out := make([]capturedRequest, 0, n)
+    for i := 1; i <= n; i++ {
+        out = append(out, c.entries[(c.next-i+len(c.entries))%len(c.entries)])
+    }
+    return out
+}
+
+// redactedHeaders are replaced before a request is captured, on top of the
+// -require-header names, which carry shared secrets too.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// withCapture records each request's method, path, headers, the first
+// maxCapturedBody bytes of its body and the response status. Headers named
+// in redactedHeaders or redact are replaced.
+func withCapture(c *Capture, redact []string, next http.Handler) http.Handler {
+    redact = append(append([]string(nil), redactedHeaders...), redact...)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(io.LimitReader(r.Body, maxCapturedBody))
+        r.Body = struct {
+            io.Reader
+            io.Closer
+        }{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+        header := r.Header.Clone()
+        for _, h := range redact {
+            if header.Get(h) != "" {
+                header.Set(h, "[REDACTED]")
+            }
+        }
+        sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(sw, r)
+        c.Add(capturedRequest{
+            Time:   now(),
+            Method: r.Method,
+            Path:   r.URL.RequestURI(),
+            Header: header,
+            Body:   string(body),
+            Status: sw.status,
+        })
+    })
+}
+
+// statusWriter captures the HTTP status code and body bytes written.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += n
+    return n, err
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+    w.status = code
+    w.ResponseWriter.WriteHeader(code)
+}
+
+// timingWriter adds a Server-Timing header just before the response
+// headers go out, measured from the access log's start time.
+type timingWriter struct {
+    http.ResponseWriter
+    start time.Time
+    wrote bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+    if !w.wrote {
+        w.wrote = true
+        ms := float64(now().Sub(w.start)) / float64(time.Millisecond)
+        w.Header().Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", ms))
+    }
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+    if !w.wrote {
+        w.WriteHeader(http.StatusOK)
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+// withLogging logs method, path, status, duration. With serverTiming it
+// also reports the time spent up to the headers in a Server-Timing header;
+// the logged duration additionally covers writing the body.
+func withLogging(serverTiming bool, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := now()
+        lw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+        var rw http.ResponseWriter = lw
+        if serverTiming {
+            rw = &timingWriter{ResponseWriter: lw, start: start}
+        }
+        next.ServeHTTP(rw, r)
+        log.Printf("%s %s %d %v", r.Method, r.URL.Path, lw.status, now().Sub(start))
+    })
+}
+
+// bufferedWriter holds a whole response so its length is known before
+// anything is sent.
+type bufferedWriter struct {
+    http.ResponseWriter
+    status int
+    buf    bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+    if w.status == 0 {
+        w.status = code
+    }
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+// withHTTP10 serves HTTP/1.0 clients with a buffered response, an explicit
+// Content-Length and Connection: close, so old integrations never have to
+// find the end of a body by waiting for EOF. HTTP/1.1 and later pass
+// through untouched and keep their keep-alive and streaming.
+func withHTTP10(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoAtLeast(1, 1) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        bw := &bufferedWriter{ResponseWriter: w}
+        next.ServeHTTP(bw, r)
+        if bw.status == 0 {
+            bw.status = http.StatusOK
+        }
+        h := w.Header()
+        h.Set("Connection", "close")
+        if bw.status >= 200 && bw.status != http.StatusNoContent && bw.status != http.StatusNotModified {
+            h.Set("Content-Length", strconv.Itoa(bw.buf.Len()))
+        }
+        w.WriteHeader(bw.status)
+        w.Write(bw.buf.Bytes())
+    })
+}
+
+// withMetrics increments request counter and records the response size and
+// status. A panic is counted as a 500 on its way out to withRecovery, which
+// sits outside this middleware and writes the actual response.
+func withMetrics(m *Metrics, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        m.Inc()
+        sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+        defer func() {
+            if p := recover(); p != nil {
+                m.ObserveStatus(http.StatusInternalServerError)
+                panic(p)
+            }
+        }()
+        next.ServeHTTP(sw, r)
+        m.ObserveSize(sw.bytes)
+        m.ObserveStatus(sw.status)
+    })
+}
+
+// withRequestID makes sure every request carries an id in header: the
+// client's if it sent one, otherwise a fresh random one. The id is set on
+// the request for downstream handlers and echoed on the response.
+func withRequestID(header string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(header)
+        if id == "" {
+            var b [8]byte
+            rand.Read(b[:])
+            id = hex.EncodeToString(b[:])
+            r.Header.Set(header, id)
+        }
+        w.Header().Set(header, id)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// withRecovery logs a handler panic with its stack and answers 500. With
+// recoverPanics off it crashes the process instead, so a supervisor restarts
+// it. The re-panic happens on a fresh goroutine because net/http recovers
+// panics raised on the handler's own goroutine and would keep serving.
+// debugErrors adds the panic message and stack to the 500 body, for local
+// development only.
+func withRecovery(recoverPanics, debugErrors bool, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            v := recover()
+            if v == nil {
+                return
+            }
+            if v == http.ErrAbortHandler {
+                panic(v)
+            }
+            stack := debug.Stack()
+            log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, stack)
+            if !recoverPanics {
+                go func() { panic(v) }()
+                select {}
+            }
+            if !debugErrors {
+                respondError(w, http.StatusInternalServerError, CodeInternal, "internal server error")
+                return
+            }
+            e := apiError{Code: CodeInternal, Message: "internal server error", Panic: fmt.Sprint(v), Stack: string(stack)}
+            encode(w, jsonCodec{}, map[string]apiError{"error": e}, http.StatusInternalServerError)
+        }()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// isOperational reports whether path is a probe or monitoring endpoint that
+// edge protections must leave reachable.
+func isOperational(path string) bool {
+    switch path {
+    case "/healthz", "/readyz", "/metrics":
+        return true
+    }
+    return false
+}
+
+// withRequiredHeaders rejects requests that lack any of the required
+// headers with the exact value, typically one injected by a gateway.
+// Operational endpoints and the index on / are exempt; the index is meant
+// to stay open as a landing page.
+func withRequiredHeaders(required headerPairs, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !isOperational(r.URL.Path) && r.URL.Path != "/" {
+            for _, h := range required {
+                if subtle.ConstantTimeCompare([]byte(r.Header.Get(h[0])), []byte(h[1])) != 1 {
+                    respondError(w, http.StatusForbidden, CodeForbidden, "forbidden")
+                    return
+                }
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Lifecycle tracks whether the server is ready to serve data. It starts
+// not ready, becomes ready once the store has loaded and stops being ready
+// again when shutdown begins.
+type Lifecycle struct {
+    ready    atomic.Bool
+    draining atomic.Bool
+    // retryAfter is what data requests are told while draining.
+    retryAfter time.Duration
+    // writes is held shared by each mutating todo request while it runs
+    // and exclusively while a graceful restart dumps the store; pausing
+    // turns new writes away while PauseWrites waits for that.
+    writes  sync.RWMutex
+    pausing atomic.Bool
+}
+
+// Ready reports whether startup has finished.
+func (l *Lifecycle) Ready() bool { return l.ready.Load() }
+
+// Drain marks the start of shutdown.
+func (l *Lifecycle) Drain() { l.draining.Store(true) }
+
+// PauseWrites turns new writes away with 503 and waits up to timeout for
+// in-flight ones to finish. On success writes stay paused until
+// ResumeWrites; on timeout they reopen and it reports false, so a client
+// stalling its request body cannot hold a restart up forever.
+func (l *Lifecycle) PauseWrites(timeout time.Duration) bool {
+    l.pausing.Store(true)
+    deadline := now().Add(timeout)
+    for !l.writes.TryLock() {
+        if now().After(deadline) {
+            l.pausing.Store(false)
+            return false
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return true
+}
+
+// ResumeWrites lets writes through again after a successful PauseWrites.
+func (l *Lifecycle) ResumeWrites() {
+    l.writes.Unlock()
+    l.pausing.Store(false)
+}
+
+func (l *Lifecycle) Name() string { return "lifecycle" }
+
+// Check fails while starting up or shutting down, holding /readyz at 503.
+func (l *Lifecycle) Check(ctx context.Context) error {
+    switch {
+    case l.draining.Load():
+        return errors.New("shutting down")
+    case !l.Ready():
+        return errors.New("starting")
+    }
+    return nil
+}
+
+// withLifecycle answers the todo routes with 503 and Retry-After until
+// startup has finished, so clients never see a half-loaded store, and again
+// once shutdown begins, so they back off and retry elsewhere. Writes get
+// the same answer while paused for a restart. Operational endpoints keep
+// working throughout.
+func withLifecycle(l *Lifecycle, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        isTodos := r.URL.Path == "/todos" || strings.HasPrefix(r.URL.Path, "/todos/")
+        switch {
+        case !isTodos:
+        case l.draining.Load():
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.retryAfter.Seconds()))))
+            respondError(w, http.StatusServiceUnavailable, CodeUnavailable, "server is shutting down")
+            return
+        case !l.Ready():
+            w.Header().Set("Retry-After", "1")
+            respondError(w, http.StatusServiceUnavailable, CodeUnavailable, "server is starting")
+            return
+        }
+        if isTodos && r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+            if l.pausing.Load() || !l.writes.TryRLock() {
+                w.Header().Set("Retry-After", "1")
+                respondError(w, http.StatusServiceUnavailable, CodeUnavailable, "server is restarting")
+                return
+            }
+            defer l.writes.RUnlock()
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// withReadOnly rejects every method other than GET and HEAD on the todo
+// routes. Operational endpoints are left alone.
+func withReadOnly(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        isTodos := r.URL.Path == "/todos" || strings.HasPrefix(r.URL.Path, "/todos/")
+        if isTodos && r.Method != http.MethodGet && r.Method != http.MethodHead {
+            w.Header().Set("Allow", "GET, HEAD")
+            respondError(w, http.StatusMethodNotAllowed, CodeReadOnly, "server is read-only")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// bucket is one client's token bucket.
+type bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// WriteLimiter is a per-client-IP token bucket for mutating requests.
+type WriteLimiter struct {
+    sync.Mutex
+    rate    float64
+    burst   float64
+    buckets map[string]*bucket
+}
+
+// NewWriteLimiter returns a limiter refilling rate tokens per second up to
+// burst.
+func NewWriteLimiter(rate float64, burst int) *WriteLimiter {
+    return &WriteLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token for key, or reports how long until one is available.
+func (l *WriteLimiter) Allow(key string) (bool, time.Duration) {
+    l.Lock()
+    defer l.Unlock()
+    t := now()
+    b, ok := l.buckets[key]
+    if !ok {
+        l.prune(t)
+        b = &bucket{tokens: l.burst, last: t}
+        l.buckets[key] = b
+    }
+    b.tokens = math.Min(l.burst, b.tokens+t.Sub(b.last).Seconds()*l.rate)
+    b.last = t
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+    }
+    b.tokens--
+    return true, 0
+}
+
+// prune drops buckets that have refilled completely; they behave exactly
+// like a fresh bucket, so forgetting them bounds memory without changing
+// any limit.
+func (l *WriteLimiter) prune(t time.Time) {
+    for k, b := range l.buckets {
+        if b.tokens+t.Sub(b.last).Seconds()*l.rate >= l.burst {
+            delete(l.buckets, k)
+        }
+    }
+}
+
+// withWriteLimit throttles POST/PUT/PATCH/DELETE per client IP, leaving
+// reads unlimited. Behind trusted proxies the client IP comes from
+// X-Forwarded-For, so clients do not share their proxy's bucket.
+// Operational endpoints are exempt.
+func withWriteLimit(l *WriteLimiter, trusted ipNets, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case isOperational(r.URL.Path):
+        case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+        default:
+            if ok, wait := l.Allow(clientIP(r, trusted).String()); !ok {
+                w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+                respondError(w, http.StatusTooManyRequests, CodeRateLimited, "too many write requests")
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// withSecurityHeaders sets hardening headers before the handler runs.
+func withSecurityHeaders(cfg *Config, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h := w.Header()
+        h.Set("X-Content-Type-Options", "nosniff")
+        if cfg.FrameOptions != "" {
+            h.Set("X-Frame-Options", cfg.FrameOptions)
+        }
+        if cfg.ServerHeader != "" {
+            h.Set("Server", cfg.ServerHeader)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// allowedMethods lists every method some route on this server accepts.
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// withOptionsAsterisk answers the asterisk-form "OPTIONS *" request that
+// proxies use to probe server capabilities. It never reaches the router.
+func withOptionsAsterisk(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.RequestURI != "*" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if r.Method != http.MethodOptions {
+            respondError(w, http.StatusBadRequest, CodeBadRequest, "asterisk request target is only valid for OPTIONS")
+            return
+        }
+        w.Header().Set("Allow", allowedMethods)
+        w.Header().Set("Content-Length", "0")
+        w.WriteHeader(http.StatusOK)
+    })
+}
+
+// withQueryLimit rejects requests carrying more than limit distinct query
+// parameters.
+func withQueryLimit(limit int, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if n := len(r.URL.Query()); n > limit {
+            debugf("Rejected %s %s: %d query params exceed limit %d", r.Method, r.URL.Path, n, limit)
+            respondError(w, http.StatusBadRequest, CodeTooManyParams, "too many query parameters")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// cleanPath mirrors path.Clean but keeps a trailing slash, which routes
+// like /todos/ rely on.
+func cleanPath(p string) string {
+    if p == "" {
+        return "/"
+    }
+    if p[0] != '/' {
+        p = "/" + p
+    }
+    np := path.Clean(p)
+    if p[len(p)-1] == '/' && np != "/" {
+        np += "/"
+    }
+    return np
+}
+
+// withCleanPath normalizes duplicate slashes and dot segments before routing.
+// GETs are redirected to the clean URL so clients learn it; other methods
+// are rewritten in place so their bodies are not lost to a redirect.
+func withCleanPath(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        clean := cleanPath(r.URL.Path)
+        if clean != r.URL.Path {
+            if r.Method == http.MethodGet || r.Method == http.MethodHead {
+                u := *r.URL
+                u.Path, u.RawPath = clean, ""
+                http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+                return
+            }
+            r.URL.Path, r.URL.RawPath = clean, ""
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// gzipBody decompresses a request body and closes both readers.
+type gzipBody struct {
+    *gzip.Reader
+    body io.ReadCloser
+}
+
+func (g gzipBody) Close() error {
+    g.Reader.Close()
+    return g.body.Close()
+}
+
+// withRequestBody caps request bodies at limit bytes. Bodies sent with
+// Content-Encoding: gzip are decompressed first and the cap applies to the
+// decompressed size, so a small zip bomb cannot expand without bound.
+func withRequestBody(limit int64, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+            zr, err := gzip.NewReader(r.Body)
+            if err != nil {
+                respondError(w, http.StatusBadRequest, CodeInvalidGzip, "invalid gzip body")
+                return
+            }
+            r.Body = gzipBody{zr, r.Body}
+            r.Header.Del("Content-Encoding")
+            r.ContentLength = -1
+        }
+        r.Body = http.MaxBytesReader(w, r.Body, limit)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// remoteIP returns the IP of the directly connected peer.
+func remoteIP(r *http.Request) net.IP {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return net.ParseIP(host)
+}
+
+// clientIP returns the IP of the client behind r. For requests relayed by
+// a trusted proxy that is the rightmost X-Forwarded-For entry not itself a
+// trusted proxy; entries further left are client-supplied and could be
+// forged. Otherwise it is the directly connected peer.
+func clientIP(r *http.Request, trusted ipNets) net.IP {
+    ip := remoteIP(r)
+    if !trusted.Contains(ip) {
+        return ip
+    }
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := net.ParseIP(strings.TrimSpace(hops[i]))
+        if hop == nil {
+            break
+        }
+        ip = hop
+        if !trusted.Contains(hop) {
+            break
+        }
+    }
+    return ip
+}
+
+// isHTTPS reports whether the client reached us over TLS, either directly
+// or, for requests relayed by a trusted proxy, per X-Forwarded-Proto.
+func isHTTPS(r *http.Request, trusted ipNets) bool {
+    if r.TLS != nil {
+        return true
+    }
+    return trusted.Contains(remoteIP(r)) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// withForceHTTPS redirects plain-HTTP requests to their https:// URL.
+// /healthz is exempt so probes that speak plain HTTP keep working, and so is
+// "OPTIONS *", which names no resource to redirect to.
+func withForceHTTPS(trusted ipNets, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/healthz" || r.RequestURI == "*" || isHTTPS(r, trusted) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+    })
+}
+
+// listenConfig builds the socket options for the main listener. Go already
+// sets SO_REUSEADDR on Unix listeners, so -reuseaddr only pins that down
+// explicitly; the accept backlog comes from the kernel's somaxconn and Go
+// offers no knob for it.
+func listenConfig(cfg *Config) *net.ListenConfig {
+    lc := &net.ListenConfig{}
+    if cfg.ReuseAddr {
+        lc.Control = func(_, _ string, c syscall.RawConn) error {
+            var serr error
+            err := c.Control(func(fd uintptr) {
+                serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+            })
+            if err != nil {
+                return err
+            }
+            return serr
+        }
+    }
+    return lc
+}
+
+// restartEnv marks a process started by a graceful restart. Its inherited
+// files are fd 3, a pipe to write one byte to once serving, then the main
+// listener and, with -admin-port, the admin listener.
+const restartEnv = "TODOSRV_RESTART"
+
+// restartTimeout bounds how long the old process waits for the new one to
+// report it is serving.
+const restartTimeout = 10 * time.Second
+
+// listen opens the listener for addr, or adopts the one inherited at fd
+// when this process was started by a graceful restart.
+func listen(cfg *Config, fd uintptr, addr string) (net.Listener, error) {
+    if os.Getenv(restartEnv) == "" {
+        return listenConfig(cfg).Listen(context.Background(), "tcp", addr)
+    }
+    f := os.NewFile(fd, addr)
+    defer f.Close()
+    return net.FileListener(f)
+}
+
+// signalParent tells the process that started us that we are accepting
+// connections and hold the loaded store, so it can shut down. It is a no-op
+// on a normal start.
+func signalParent() {
+    if os.Getenv(restartEnv) == "" {
+        return
+    }
+    os.Unsetenv(restartEnv)
+    f := os.NewFile(3, "ready")
+    f.Write([]byte{1})
+    f.Close()
+}
+
+// restart re-executes the running binary with the same arguments, handing
+// it the listening sockets, and returns once the child reports it is
+// serving. Unix-only: it relies on fd inheritance and SIGUSR2.
+func restart(listeners ...net.Listener) (int, error) {
+    exe, err := os.Executable()
+    if err != nil {
+        return 0, err
+    }
+    r, w, err := os.Pipe()
+    if err != nil {
+        return 0, err
+    }
+    defer r.Close()
+    files := []*os.File{w}
+    for _, ln := range listeners {
+        f, err := ln.(*net.TCPListener).File()
+        if err != nil {
+            w.Close()
+            return 0, err
+        }
+        defer f.Close()
+        files = append(files, f)
+    }
+    cmd := exec.Command(exe, os.Args[1:]...)
+    cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+    cmd.Env = append(os.Environ(), restartEnv+"=1")
+    cmd.ExtraFiles = files
+    err = cmd.Start()
+    w.Close()
+    if err != nil {
+        return 0, err
+    }
+    // Only the ready byte counts as success. A child that dies first closes
+    // the pipe, so EOF, like the timeout, means it never got there; Wait
+    // reaps it and catches an exit even before the read returns.
+    ready := make(chan error, 1)
+    go func() {
+        r.SetReadDeadline(now().Add(restartTimeout))
+        _, err := io.ReadFull(r, make([]byte, 1))
+        ready <- err
+    }()
+    exited := make(chan error, 1)
+    go func() { exited <- cmd.Wait() }()
+    select {
+    case err := <-exited:
+        if err == nil {
+            err = errors.New("exit status 0")
+        }
+        return 0, fmt.Errorf("new process exited during startup: %v", err)
+    case err := <-ready:
+        if err != nil {
+            cmd.Process.Kill()
+            return 0, fmt.Errorf("new process did not report ready: %v", err)
+        }
+    }
+    return cmd.Process.Pid, nil
+}
+
+// newHandler wires every route and middleware for cfg. It returns the
+// handler for the main port and ops, the control-plane mux: part of the
+// main handler, or served on its own with -admin-port.
+func newHandler(cfg *Config, store *Store, life *Lifecycle, metrics *Metrics, conns *ConnLimiter) (http.Handler, *http.ServeMux) {
+    // Encoding and logging helpers read these package settings rather than
+    // take cfg at every call.
+    timeFormat = cfg.TimeFormat
+    idPrefix = cfg.IDPrefix
+    logLevel = cfg.LogLevel
+    omitEmpty = cfg.OmitEmpty
+    jsonNaming = cfg.JSONNaming
+    defaultSort, _ := parseSort(cfg.DefaultSort)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        if strings.Contains(r.Header.Get("Accept"), "application/json") {
+            respond(w, r, map[string]interface{}{
+                "status":         "ok",
+                "version":        version,
+                "uptime_seconds": int(now().Sub(startTime).Seconds()),
+            }, http.StatusOK)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte("ok"))
+    })
+    mux.HandleFunc("/version", func(w http.ResponseWriter, _ *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(version))
+    })
+
+    // Control-plane routes live on ops: the main mux by default, or a
+    // separate server with -admin-port.
+    ops := mux
+    if cfg.AdminPort != 0 {
+        ops = http.NewServeMux()
+    }
+    ops.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+        var snap interface{} = metrics.Snapshot(store)
+        if reshaping() {
+            snap, _ = reshapeJSON(snap)
+        }
+        js, _ := json.MarshalIndent(snap, "", "  ")
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(js)
+    })
+    checkers := []HealthChecker{life, store}
+    ops.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+        ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+        defer cancel()
+        ok, results := checkHealth(ctx, checkers)
+        code, status := http.StatusOK, "ok"
+        if !ok {
+            code, status = http.StatusServiceUnavailable, "unavailable"
+        }
+        if r.URL.Query().Get("verbose") == "true" {
+            respond(w, r, map[string]interface{}{"status": status, "checks": results}, code)
+            return
+        }
+        w.WriteHeader(code)
+        w.Write([]byte(status))
+    })
+    ops.HandleFunc("/metrics/reset", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+            return
+        }
+        metrics.Reset()
+        w.WriteHeader(http.StatusNoContent)
+    })
+    // Per-IP connection counts identify clients, so keep them off the
+    // public port unless asked for.
+    if cfg.AdminPort != 0 || cfg.DebugConns {
+        ops.HandleFunc("/debug/conns", func(w http.ResponseWriter, r *http.Request) {
+            respond(w, r, conns.Snapshot(), http.StatusOK)
+        })
+    }
+    // The config maps out the deployment even with secrets redacted.
+    if cfg.AdminPort != 0 || cfg.DebugConfig {
+        ops.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+                return
+            }
+            respond(w, r, cfg.Redacted(), http.StatusOK)
+        })
+    }
+    var capture *Capture
+    if cfg.CaptureBodies > 0 {
+        capture = NewCapture(cfg.CaptureBodies)
+        ops.HandleFunc("/debug/requests", func(w http.ResponseWriter, r *http.Request) {
+            respond(w, r, capture.Recent(), http.StatusOK)
+        })
+    }
+    if cfg.Pprof {
+        ops.HandleFunc("/debug/pprof/", pprof.Index)
+        ops.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+        ops.HandleFunc("/debug/pprof/profile", pprof.Profile)
+        ops.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+        ops.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    }
+
+    if cfg.Index {
+        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+            if r.URL.Path != "/" {
+                respondError(w, http.StatusNotFound, CodeRouteNotFound, "not found")
+                return
+            }
+            if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+                return
+            }
+            respond(w, r, map[string]interface{}{"version": version, "endpoints": servedEndpoints(mux)}, http.StatusOK)
+        })
+    }
+    todosHandler := func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead:
+            q := r.URL.Query()
+            ndjson := strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+            if ndjson && (q.Has("ids") || q.Has("page") || q.Has("per_page") || q.Has("with_count") || r.Header.Get("Range") != "") {
+                respondError(w, http.StatusNotAcceptable, CodeNotAcceptable, "application/x-ndjson cannot be combined with ids, pagination, with_count or Range")
+                return
+            }
+            if q.Has("ids") {
+                respondBatch(w, r, store, q.Get("ids"))
+                return
+            }
+            withCount := false
+            if v := q.Get("with_count"); v != "" {
+                b, err := strconv.ParseBool(v)
+                if err != nil {
+                    respondError(w, http.StatusBadRequest, CodeInvalidQuery, fmt.Sprintf("invalid with_count %q", v))
+                    return
+                }
+                withCount = b
+            }
+            less := defaultSort
+            if v := q.Get("sort"); v != "" {
+                var err error
+                if less, err = parseSort(v); err != nil {
+                    respondError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+                    return
+                }
+            }
+            etag := store.ListETag()
+            if etagMatch(r.Header.Get("If-None-Match"), etag) {
+                w.Header().Set("ETag", etag)
+                w.WriteHeader(http.StatusNotModified)
+                return
+            }
+            // Everything below works from this one snapshot, taken under a
+            // single read lock, so a page and its total always agree.
+            todos, err := store.List(r.Context())
+            if err != nil {
+                clientGone(r, err)
+                return
+            }
+            if todos, err = filterCompleted(todos, q); err != nil {
+                respondError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+                return
+            }
+            sortTodos(todos, less)
+            w.Header().Set("ETag", etag)
+            if ndjson {
+                streamNDJSON(w, todos)
+                return
+            }
+            if q.Has("page") || q.Has("per_page") {
+                p, err := paginate(todos, q, cfg.PageDefault, cfg.PageMax)
+                if err != nil {
+                    respondError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+                    return
+                }
+                respond(w, r, p, http.StatusOK)
+                return
+            }
+            w.Header().Set("Accept-Ranges", "items")
+            if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "items="); ok {
+                first, last, ok := parseItemsRange(spec, len(todos))
+                if !ok {
+                    w.Header().Set("Content-Range", fmt.Sprintf("items */%d", len(todos)))
+                    respondError(w, http.StatusRequestedRangeNotSatisfiable, CodeRangeNotSatisfiable, "range not satisfiable")
+                    return
+                }
+                w.Header().Set("Content-Range", fmt.Sprintf("items %d-%d/%d", first, last, len(todos)))
+                respond(w, r, todos[first:last+1], http.StatusPartialContent)
+                return
+            }
+            // Other range units are ignored, as RFC 9110 allows, and get
+            // the capped list like any request without a Range.
+            if len(todos) > cfg.PageDefault {
+                // Protect clients that ignore pagination from unbounded
+                // responses: cap the list and switch to the envelope so the
+                // truncation cannot go unnoticed.
+                w.Header().Set("Warning", fmt.Sprintf(`299 - "list truncated to %d of %d todos; use ?page= or Range"`, cfg.PageDefault, len(todos)))
+                respond(w, r, countedList{Items: todos[:cfg.PageDefault], Total: len(todos), Truncated: true}, http.StatusOK)
+                return
+            }
+            if withCount {
+                respond(w, r, countedList{Items: todos, Total: len(todos)}, http.StatusOK)
+                return
+            }
+            respond(w, r, todos, http.StatusOK)
+        case http.MethodPost:
+            var payload struct {
+                Title     string `json:"title"`
+                Completed bool   `json:"completed"`
+            }
+            if !decodeJSON(w, r, &payload) {
+                return
+            }
+            if strings.TrimSpace(payload.Title) == "" {
+                respondError(w, http.StatusBadRequest, CodeInvalidTitle, "title must not be blank")
+                return
+            }
+            t := store.Create(payload.Title, payload.Completed)
+            respondWrite(w, r, t, t, http.StatusCreated)
+        default:
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+        }
+    }
+    mux.HandleFunc("/todos", todosHandler)
+    mux.HandleFunc("/todos/schema", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+            return
+        }
+        respond(w, r, todoSchema(cfg), http.StatusOK)
+    })
+    mux.HandleFunc("/todos/grouped", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+            return
+        }
+        open, completed, err := store.Grouped(r.Context())
+        if err != nil {
+            clientGone(r, err)
+            return
+        }
+        respond(w, r, map[string][]*Todo{"open": open, "completed": completed}, http.StatusOK)
+    })
+    for name, find := range map[string]func(context.Context) (*Todo, bool, error){
+        "oldest": store.Oldest,
+        "newest": store.Newest,
+    } {
+        mux.HandleFunc("/todos/"+name, func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+                return
+            }
+            t, ok, err := find(r.Context())
+            switch {
+            case err != nil:
+                clientGone(r, err)
+            case !ok:
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "no todos")
+            default:
+                respond(w, r, t, http.StatusOK)
+            }
+        })
+    }
+    mux.HandleFunc("/todos/recent", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+            return
+        }
+        n := defaultRecent
+        if v := r.URL.Query().Get("n"); v != "" {
+            var err error
+            if n, err = strconv.Atoi(v); err != nil || n < 1 {
+                respondError(w, http.StatusBadRequest, CodeInvalidQuery, "invalid n")
+                return
+            }
+        }
+        if n > maxRecent {
+            n = maxRecent
+        }
+        recent, err := store.Recent(r.Context(), n)
+        if err != nil {
+            clientGone(r, err)
+            return
+        }
+        respond(w, r, recent, http.StatusOK)
+    })
+    mux.HandleFunc("/todos/", func(w http.ResponseWriter, r *http.Request) {
+        rest := strings.TrimPrefix(r.URL.Path, "/todos/")
+        if rest == "" {
+            // /todos/ is the collection, not an empty id.
+            todosHandler(w, r)
+            return
+        }
+        idStr, action, _ := strings.Cut(rest, "/")
+        id, ok := store.ParseID(idStr)
+        if !ok {
+            respondError(w, http.StatusBadRequest, CodeInvalidID, "invalid id")
+            return
+        }
+        switch action {
+        case "":
+        case "touch":
+            if r.Method != http.MethodPost {
+                respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+                return
+            }
+            if t, ok := store.Touch(id); ok {
+                w.Header().Set("ETag", itemETag(t))
+                respond(w, r, t, http.StatusOK)
+            } else {
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "todo not found")
+            }
+            return
+        default:
+            respondError(w, http.StatusNotFound, CodeRouteNotFound, "not found")
+            return
+        }
+        switch r.Method {
+        case http.MethodGet, http.MethodHead:
+            if t, ok := store.Get(id); ok {
+                w.Header().Set("ETag", itemETag(t))
+                respond(w, r, t, http.StatusOK)
+            } else {
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "todo not found")
             }
         case http.MethodPut:
             var payload struct {
                 Title     string `json:"title"`
                 Completed bool   `json:"completed"`
             }
-            if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-                http.Error(w, "invalid payload", http.StatusBadRequest)
+            if !decodeJSON(w, r, &payload) {
                 return
             }
-            if t, ok := store.Update(id, payload.Title, payload.Completed); ok {
-                respondJSON(w, t, http.StatusOK)
+            if t, changed, ok := store.Update(id, payload.Title, payload.Completed); ok {
+                respondWrite(w, r, t, updateResult{t.view(), changed}, http.StatusOK)
             } else {
-                http.Error(w, "not found", http.StatusNotFound)
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "todo not found")
+            }
+        case http.MethodPatch:
+            if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json-patch+json" {
+                w.Header().Set("Accept-Patch", "application/json-patch+json")
+                respondError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "PATCH requires Content-Type: application/json-patch+json")
+                return
+            }
+            var ops []patchOp
+            if !decodeJSON(w, r, &ops) {
+                return
+            }
+            if err := validatePatch(ops); err != nil {
+                respondError(w, http.StatusUnprocessableEntity, CodeInvalidPatch, err.Error())
+                return
+            }
+            t, changed, err := store.Patch(id, ops)
+            switch {
+            case errors.Is(err, errTodoNotFound):
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "todo not found")
+            case errors.Is(err, errPatchTest):
+                respondError(w, http.StatusConflict, CodePatchTestFailed, err.Error())
+            case err != nil:
+                log.Printf("Patching todo %d failed: %v", id, err)
+                respondError(w, http.StatusInternalServerError, CodeInternal, "internal server error")
+            default:
+                respondWrite(w, r, t, updateResult{t.view(), changed}, http.StatusOK)
             }
         case http.MethodDelete:
-            if store.Delete(id) {
+            var cond func(*Todo) bool
+            if h := r.Header.Get("If-Match"); h != "" {
+                cond = func(t *Todo) bool { return ifMatch(h, itemETag(t)) }
+            }
+            switch err := store.DeleteIf(id, cond); err {
+            case nil:
                 w.WriteHeader(http.StatusNoContent)
-            } else {
-                http.Error(w, "not found", http.StatusNotFound)
+            case errPrecondition:
+                respondError(w, http.StatusPreconditionFailed, CodePreconditionFailed, "todo changed since the If-Match ETag was issued")
+            default:
+                respondError(w, http.StatusNotFound, CodeTodoNotFound, "todo not found")
             }
         default:
-            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
         }
     })
 
-    handler := withLogging(withMetrics(metrics, mux))
+    var handler http.Handler = mux
+    if cfg.ReadOnly {
+        handler = withReadOnly(handler)
+    }
+    handler = withLifecycle(life, handler)
+    if cfg.WriteRate > 0 {
+        handler = withWriteLimit(NewWriteLimiter(cfg.WriteRate, cfg.WriteBurst), cfg.TrustedProxies, handler)
+    }
+    if len(cfg.RequireHeaders) > 0 {
+        handler = withRequiredHeaders(cfg.RequireHeaders, handler)
+    }
+    if capture != nil {
+        var secrets []string
+        for _, h := range cfg.RequireHeaders {
+            secrets = append(secrets, h[0])
+        }
+        handler = withCapture(capture, secrets, handler)
+    }
+    handler = withMetrics(metrics, withOptionsAsterisk(withQueryLimit(cfg.MaxQueryParams, withCleanPath(withRequestBody(cfg.MaxBodyBytes, handler)))))
+    if cfg.SecurityHeaders {
+        handler = withSecurityHeaders(cfg, handler)
+    }
+    if cfg.ForceHTTPS {
+        handler = withForceHTTPS(cfg.TrustedProxies, handler)
+    }
+    handler = withRequestID(cfg.RequestIDHeader, withLogging(cfg.ServerTiming, withHTTP10(withRecovery(cfg.RecoverPanics, cfg.DebugErrors, handler))))
+    return handler, ops
+}
+
+func main() {
+    startTime = now()
+    cfg := defaultConfig()
+    flag.IntVar(&cfg.Port, "port", cfg.Port, "server port")
+    flag.StringVar(&cfg.IDType, "id-type", cfg.IDType, "todo id type: int or uuid")
+    flag.StringVar(&cfg.IDPrefix, "id-prefix", cfg.IDPrefix, "prefix for ids in responses, e.g. todo_ (accepted but optional in paths)")
+    flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", cfg.MaxBodyBytes, "maximum request body size, after gzip decompression")
+    flag.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes, "maximum size of request headers")
+    flag.IntVar(&cfg.MaxQueryParams, "max-query-params", cfg.MaxQueryParams, "maximum distinct query parameters per request")
+    flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "close new connections from a client IP already holding this many; trusted proxies exempt (0 = unlimited)")
+    flag.BoolVar(&cfg.NoKeepAlives, "disable-keepalives", cfg.NoKeepAlives, "close the connection after every response")
+    flag.StringVar(&cfg.JSONNaming, "json-naming", cfg.JSONNaming, "JSON field naming in responses: snake or camel")
+    flag.BoolVar(&cfg.OmitEmpty, "omit-empty", cfg.OmitEmpty, "leave empty optional todo fields (completed_at) out of JSON responses")
+    flag.StringVar(&cfg.RequestIDHeader, "request-id-header", cfg.RequestIDHeader, "header carrying the request id, read from clients and echoed back")
+    flag.BoolVar(&cfg.ReuseAddr, "reuseaddr", cfg.ReuseAddr, "set SO_REUSEADDR on the listening socket explicitly")
+    flag.StringVar(&cfg.TimeFormat, "time-format", cfg.TimeFormat, "JSON timestamp format: rfc3339, rfc3339nano, unix or unixmilli")
+    flag.BoolVar(&cfg.ForceHTTPS, "force-https", cfg.ForceHTTPS, "redirect plain-HTTP requests to https:// (except /healthz)")
+    flag.Var(&cfg.TrustedProxies, "trusted-proxies", "comma-separated proxy IPs/CIDRs whose X-Forwarded-* headers are trusted")
+    flag.BoolVar(&cfg.RecoverPanics, "recover-panics", cfg.RecoverPanics, "answer handler panics with 500; false crashes the process instead")
+    flag.BoolVar(&cfg.DebugErrors, "debug-errors", cfg.DebugErrors, "include the panic message and stack trace in 500 responses (development only)")
+    flag.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "serve net/http/pprof profiles under /debug/pprof/")
+    flag.IntVar(&cfg.AdminPort, "admin-port", cfg.AdminPort, "serve /metrics and /debug/pprof/ on this port instead of the main one (0 = disabled)")
+    flag.IntVar(&cfg.CaptureBodies, "capture-bodies", cfg.CaptureBodies, "keep the last N requests with bodies for GET /debug/requests (0 = disabled, max 1000)")
+    flag.BoolVar(&cfg.DebugConns, "debug-conns", cfg.DebugConns, "serve GET /debug/conns on the main port too (always on with -admin-port)")
+    flag.BoolVar(&cfg.DebugConfig, "debug-config", cfg.DebugConfig, "serve GET /debug/config on the main port too (always on with -admin-port)")
+    flag.IntVar(&cfg.PageDefault, "page-default", cfg.PageDefault, "default per_page for paginated GET /todos")
+    flag.IntVar(&cfg.PageMax, "page-max", cfg.PageMax, "maximum per_page for paginated GET /todos")
+    flag.StringVar(&cfg.DefaultSort, "default-sort", cfg.DefaultSort, "GET /todos order without ?sort=: id, title, created_at or updated_at, - prefix for descending")
+    flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log verbosity: info or debug")
+    flag.BoolVar(&cfg.ReadOnly, "read-only", cfg.ReadOnly, "reject POST/PUT/PATCH/DELETE on the todo routes with 405")
+    flag.DurationVar(&cfg.SlowStore, "slow-store-threshold", cfg.SlowStore, "log store operations slower than this, e.g. 5ms (0 = disabled)")
+    flag.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "maximum time to read a whole request, body included (0 = no limit)")
+    flag.DurationVar(&cfg.ReadHdrTimeout, "read-header-timeout", cfg.ReadHdrTimeout, "maximum time to read request headers (0 = no limit)")
+    flag.DurationVar(&cfg.DrainDelay, "drain-delay", cfg.DrainDelay, "on shutdown, report unready and keep serving this long before closing listeners")
+    flag.DurationVar(&cfg.ShutdownRetry, "shutdown-retry-after", cfg.ShutdownRetry, "Retry-After sent with 503s to data requests once shutdown begins")
+    flag.StringVar(&cfg.DumpOnExit, "dump-on-exit", cfg.DumpOnExit, "write todos to this file on graceful shutdown and reload them at startup")
+    flag.Float64Var(&cfg.WriteRate, "write-rate", cfg.WriteRate, "per-client-IP limit on mutating requests per second (0 disables)")
+    flag.IntVar(&cfg.WriteBurst, "write-burst", cfg.WriteBurst, "mutating requests a client IP may send in a burst under -write-rate")
+    flag.Var(&cfg.RequireHeaders, "require-header", "reject requests lacking this exact KEY=VALUE header with 403 (repeatable)")
+    flag.BoolVar(&cfg.ServerTiming, "server-timing", cfg.ServerTiming, "add a Server-Timing: app;dur=<ms> header to every response")
+    flag.BoolVar(&cfg.Index, "index", cfg.Index, "serve an endpoint index on GET /")
+    flag.BoolVar(&cfg.SecurityHeaders, "security-headers", cfg.SecurityHeaders, "send security headers on every response")
+    flag.StringVar(&cfg.FrameOptions, "frame-options", cfg.FrameOptions, "X-Frame-Options value with -security-headers (empty to omit)")
+    flag.StringVar(&cfg.ServerHeader, "server-header", cfg.ServerHeader, "Server header value with -security-headers (empty to omit)")
+    flag.Parse()
+    if err := cfg.Validate(); err != nil {
+        log.Fatalf("Invalid config: %v", err)
+    }
+    store := NewStore(cfg.IDType)
+    store.slowThreshold = cfg.SlowStore
+    life := &Lifecycle{retryAfter: cfg.ShutdownRetry}
+    metrics := &Metrics{}
+    conns := NewConnLimiter(cfg.MaxConnsPerIP, cfg.TrustedProxies)
+
+    handler, ops := newHandler(cfg, store, life, metrics, conns)
     server := &http.Server{
-        Addr:    fmt.Sprintf(":%d", *port),
+        Addr:    fmt.Sprintf(":%d", cfg.Port),
         Handler: handler,
+        ConnState: func(c net.Conn, state http.ConnState) {
+            metrics.ConnState(c, state)
+            conns.ConnState(c, state)
+        },
+        // MaxHeaderBytes bounds how large headers may grow, not how long a
+        // client may take to send them; that is ReadHeaderTimeout's job.
+        // ReadTimeout also frees a write stalled mid-body, which would
+        // otherwise hold up a graceful restart.
+        MaxHeaderBytes:    cfg.MaxHeaderBytes,
+        ReadTimeout:       cfg.ReadTimeout,
+        ReadHeaderTimeout: cfg.ReadHdrTimeout,
+        // withOptionsAsterisk replaces net/http's built-in reply, which
+        // omits the Allow header.
+        DisableGeneralOptionsHandler: true,
+    }
+
+    if cfg.NoKeepAlives {
+        server.SetKeepAlivesEnabled(false)
+    }
+
+    ln, err := listen(cfg, 4, server.Addr)
+    if err != nil {
+        log.Fatalf("Listen error: %v", err)
+    }
+    var adminServer *http.Server
+    var adminLn net.Listener
+    if cfg.AdminPort != 0 {
+        adminServer = &http.Server{
+            Addr:              fmt.Sprintf(":%d", cfg.AdminPort),
+            Handler:           withLogging(cfg.ServerTiming, withRecovery(cfg.RecoverPanics, cfg.DebugErrors, ops)),
+            MaxHeaderBytes:    cfg.MaxHeaderBytes,
+            ReadTimeout:       cfg.ReadTimeout,
+            ReadHeaderTimeout: cfg.ReadHdrTimeout,
+        }
+        adminLn, err = listen(cfg, 5, adminServer.Addr)
+        if err != nil {
+            log.Fatalf("Admin listen error: %v", err)
+        }
+        go func() {
+            log.Printf("🛠️ Admin server listening on :%d", cfg.AdminPort)
+            if err := adminServer.Serve(adminLn); err != http.ErrServerClosed {
+                log.Fatalf("Admin server error: %v", err)
+            }
+        }()
     }
 
-    // Graceful shutdown
+    // Graceful restart and shutdown run on separate goroutines, so SIGINT
+    // is honored even while a restart is waiting on its child.
+    handedOff := make(chan struct{})
+    go func() {
+        c := make(chan os.Signal, 1)
+        signal.Notify(c, syscall.SIGUSR2)
+        for range c {
+            if !life.Ready() {
+                log.Printf("Restart ignored, still starting up")
+                continue
+            }
+            // Todos reach the new process only through the dump file.
+            if cfg.DumpOnExit == "" {
+                log.Printf("Restart refused: without -dump-on-exit the new process would start with no todos")
+                continue
+            }
+            // Stop writes before dumping so the child loads everything this
+            // process acknowledged; they stay stopped until it exits, or
+            // reopen if the handoff fails.
+            if !life.PauseWrites(restartTimeout) {
+                log.Printf("Restart aborted, in-flight writes did not finish within %v", restartTimeout)
+                continue
+            }
+            if _, err := store.Dump(cfg.DumpOnExit); err != nil {
+                life.ResumeWrites()
+                log.Printf("Restart aborted, dumping todos failed: %v", err)
+                continue
+            }
+            listeners := []net.Listener{ln}
+            if adminLn != nil {
+                listeners = append(listeners, adminLn)
+            }
+            pid, err := restart(listeners...)
+            if err != nil {
+                life.ResumeWrites()
+                log.Printf("Restart failed: %v", err)
+                continue
+            }
+            log.Printf("🔁 Handed listeners to pid %d, closing ours", pid)
+            close(handedOff)
+            return
+        }
+    }()
     idle := make(chan struct{})
     go func() {
         c := make(chan os.Signal, 1)
         signal.Notify(c, os.Interrupt)
-        <-c
-        log.Println("🔌 Shutdown signal received")
+        // After a handoff the new process accepts on the same sockets, so
+        // close ours at once rather than turn its clients away with 503.
+        dump := false
+        select {
+        case <-handedOff:
+        case <-c:
+            log.Println("🔌 Shutdown signal received")
+            // Go unready first: load balancers see /readyz fail and data
+            // requests that still arrive are told to retry elsewhere.
+            life.Drain()
+            if cfg.DrainDelay > 0 {
+                log.Printf("⏳ Draining for %v before closing listeners", cfg.DrainDelay)
+                time.Sleep(cfg.DrainDelay)
+            }
+            dump = true
+        }
         ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
         defer cancel()
         server.Shutdown(ctx)
+        if adminServer != nil {
+            adminServer.Shutdown(ctx)
+        }
+        // Before the load finishes the store is partial; dumping it would
+        // overwrite the file with less than it holds.
+        if cfg.DumpOnExit != "" && dump && life.Ready() {
+            if n, err := store.Dump(cfg.DumpOnExit); err != nil {
+                log.Printf("Dumping todos failed: %v", err)
+            } else {
+                log.Printf("💾 Dumped %d todos to %s", n, cfg.DumpOnExit)
+            }
+        }
         close(idle)
     }()
 
-    log.Printf("🚀 Server v%s listening on :%d", version, *port)
-    if err := server.ListenAndServe(); err != http.ErrServerClosed {
+    log.Printf("⚙️ Effective config: %s", cfg.Summary())
+    if cfg.DebugErrors {
+        log.Println("⚠️ -debug-errors is on: 500 responses expose panic messages and stack traces")
+    }
+    log.Printf("🚀 Server v%s listening on :%d", version, cfg.Port)
+    // Load after the listener is up so liveness probes pass during a slow
+    // load; readiness and the data routes wait for it.
+    go func() {
+        if cfg.DumpOnExit != "" {
+            n, err := store.Load(cfg.DumpOnExit)
+            switch {
+            case errors.Is(err, os.ErrNotExist):
+            case err != nil:
+                log.Fatalf("Loading dump: %v", err)
+            default:
+                log.Printf("📂 Loaded %d todos from %s", n, cfg.DumpOnExit)
+            }
+        }
+        life.ready.Store(true)
+        signalParent()
+    }()
+    if err := server.Serve(ln); err != http.ErrServerClosed {
         log.Fatalf("Server error: %v", err)
     }
     <-idle
     log.Println("👋 Goodbye")
 }
 
-func respondJSON(w http.ResponseWriter, data interface{}, code int) {
-    w.Header().Set("Content-Type", "application/json")
+// Codec serializes response bodies in one media type.
+type Codec interface {
+    ContentType() string
+    Encode(w io.Writer, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) }
+
+// negotiate picks the response codec from the Accept header, honoring q
+// values. JSON is the default and wins ties, so MessagePack must be
+// preferred explicitly; when Accept rules out both, JSON is sent anyway.
+func negotiate(r *http.Request) Codec {
+    accept := r.Header.Get("Accept")
+    msgpack := math.Max(acceptQ(accept, "application/msgpack"), acceptQ(accept, "application/x-msgpack"))
+    if msgpack > acceptQ(accept, "application/json") {
+        return msgpackCodec{}
+    }
+    return jsonCodec{}
+}
+
+// acceptQ returns the q value an Accept header gives mediaType, taken from
+// the most specific matching range (type/subtype, then type/*, then */*):
+// 1 for an empty header, 0 when no range matches.
+func acceptQ(accept, mediaType string) float64 {
+    if strings.TrimSpace(accept) == "" {
+        return 1
+    }
+    major, _, _ := strings.Cut(mediaType, "/")
+    best, q := -1, 0.0
+    for _, part := range strings.Split(accept, ",") {
+        mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+        if err != nil {
+            continue
+        }
+        specificity := -1
+        switch mt {
+        case mediaType:
+            specificity = 2
+        case major + "/*":
+            specificity = 1
+        case "*/*":
+            specificity = 0
+        }
+        if specificity <= best {
+            continue
+        }
+        best, q = specificity, 1
+        if v, ok := params["q"]; ok {
+            if f, err := strconv.ParseFloat(v, 64); err == nil {
+                q = f
+            }
+        }
+    }
+    return q
+}
+
+// respond writes data in the format r negotiated.
+func respond(w http.ResponseWriter, r *http.Request, data interface{}, code int) {
+    w.Header().Add("Vary", "Accept")
+    encode(w, negotiate(r), data, code)
+}
+
+// encode writes data with codec c, reshaping it first if configured.
+func encode(w http.ResponseWriter, c Codec, data interface{}, code int) {
+    if reshaping() {
+        var err error
+        if data, err = reshapeJSON(data); err != nil {
+            log.Printf("Response encoding failed: %v", err)
+            respondError(w, http.StatusInternalServerError, CodeInternal, "internal server error")
+            return
+        }
+    }
+    w.Header().Set("Content-Type", c.ContentType())
     w.WriteHeader(code)
-    json.NewEncoder(w).Encode(data)
+    if err := c.Encode(w, data); err != nil {
+        if isDisconnect(err) {
+            debugf("response not delivered, client went away: %v", err)
+            return
+        }
+        log.Printf("Response encoding failed: %v", err)
+    }
+}
+
+// msgpackCodec encodes MessagePack. It converts the JSON form of a value
+// rather than reflecting over Go types, so every MarshalJSON, -time-format
+// and field name applies to both formats alike.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+    raw, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    dec := json.NewDecoder(bytes.NewReader(raw))
+    dec.UseNumber()
+    tree, err := decodeOrdered(dec)
+    if err != nil {
+        return err
+    }
+    b, err := appendMsgpack(nil, tree)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(b)
+    return err
+}
+
+// appendMsgpack appends the MessagePack encoding of a decodeOrdered value.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+    switch v := v.(type) {
+    case nil:
+        return append(b, 0xc0), nil
+    case bool:
+        if v {
+            return append(b, 0xc3), nil
+        }
+        return append(b, 0xc2), nil
+    case json.Number:
+        if n, err := v.Int64(); err == nil {
+            return appendMsgpackInt(b, n), nil
+        }
+        f, err := v.Float64()
+        if err != nil {
+            return nil, err
+        }
+        return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+    case string:
+        b = appendMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+        return append(b, v...), nil
+    case []interface{}:
+        b = appendMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+        for _, e := range v {
+            var err error
+            if b, err = appendMsgpack(b, e); err != nil {
+                return nil, err
+            }
+        }
+        return b, nil
+    case jsonObject:
+        b = appendMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+        for _, m := range v {
+            b = appendMsgpackHeader(b, len(m.Key), 0xa0, 32, 0xd9, 0xda, 0xdb)
+            b = append(b, m.Key...)
+            var err error
+            if b, err = appendMsgpack(b, m.Value); err != nil {
+                return nil, err
+            }
+        }
+        return b, nil
+    }
+    return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+// appendMsgpackHeader writes the type and length prefix of a str, array or
+// map: a fix form below fixMax, then the 8-bit (if the type has one),
+// 16-bit and 32-bit length forms.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, len8, len16, len32 byte) []byte {
+    switch {
+    case n < fixMax:
+        return append(b, fix|byte(n))
+    case len8 != 0 && n <= math.MaxUint8:
+        return append(b, len8, byte(n))
+    case n <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, len16), uint16(n))
+    }
+    return binary.BigEndian.AppendUint32(append(b, len32), uint32(n))
+}
+
+// appendMsgpackInt writes n in the smallest MessagePack integer form.
+func appendMsgpackInt(b []byte, n int64) []byte {
+    switch {
+    case n >= 0 && n <= math.MaxInt8:
+        return append(b, byte(n))
+    case n < 0 && n >= -32:
+        return append(b, byte(n))
+    case n >= 0 && n <= math.MaxUint8:
+        return append(b, 0xcc, byte(n))
+    case n >= 0 && n <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+    case n >= 0 && n <= math.MaxUint32:
+        return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+    case n >= 0:
+        return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(n))
+    case n >= math.MinInt8:
+        return append(b, 0xd0, byte(n))
+    case n >= math.MinInt16:
+        return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+    case n >= math.MinInt32:
+        return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+    }
+    return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// jsonObject is a decoded JSON object that keeps its members in order, so
+// reshaped responses keep the field order of the structs they came from.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+    Key   string
+    Value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+    var b bytes.Buffer
+    b.WriteByte('{')
+    for i, m := range o {
+        if i > 0 {
+            b.WriteByte(',')
+        }
+        k, _ := json.Marshal(m.Key)
+        v, err := json.Marshal(m.Value)
+        if err != nil {
+            return nil, err
+        }
+        b.Write(k)
+        b.WriteByte(':')
+        b.Write(v)
+    }
+    b.WriteByte('}')
+    return b.Bytes(), nil
+}
+
+// decodeOrdered reads one JSON value, decoding objects as jsonObject.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+    tok, err := dec.Token()
+    if err != nil {
+        return nil, err
+    }
+    switch tok {
+    case json.Delim('{'):
+        obj := jsonObject{}
+        for dec.More() {
+            key, err := dec.Token()
+            if err != nil {
+                return nil, err
+            }
+            v, err := decodeOrdered(dec)
+            if err != nil {
+                return nil, err
+            }
+            obj = append(obj, jsonMember{key.(string), v})
+        }
+        _, err = dec.Token()
+        return obj, err
+    case json.Delim('['):
+        arr := []interface{}{}
+        for dec.More() {
+            v, err := decodeOrdered(dec)
+            if err != nil {
+                return nil, err
+            }
+            arr = append(arr, v)
+        }
+        _, err = dec.Token()
+        return arr, err
+    }
+    return tok, nil
+}
+
+// reshapeJSON round-trips a response through its JSON form and applies the
+// output options that struct tags cannot express: -omit-empty and
+// -json-naming.
+func reshapeJSON(data interface{}) (interface{}, error) {
+    raw, err := json.Marshal(data)
+    if err != nil {
+        return nil, err
+    }
+    dec := json.NewDecoder(bytes.NewReader(raw))
+    dec.UseNumber()
+    v, err := decodeOrdered(dec)
+    if err != nil {
+        return nil, err
+    }
+    if omitEmpty {
+        v = pruneEmpty(v)
+    }
+    if jsonNaming == "camel" {
+        v = renameKeys(v)
+    }
+    return v, nil
+}
+
+// reshaping reports whether responses must go through reshapeJSON.
+func reshaping() bool { return omitEmpty || jsonNaming == "camel" }
+
+// renameKeys converts every object key to the configured naming.
+func renameKeys(v interface{}) interface{} {
+    switch v := v.(type) {
+    case jsonObject:
+        for i := range v {
+            v[i].Key = wireName(v[i].Key)
+            v[i].Value = renameKeys(v[i].Value)
+        }
+    case []interface{}:
+        for i := range v {
+            v[i] = renameKeys(v[i])
+        }
+    }
+    return v
+}
+
+// optionalFields are the todo members -omit-empty may leave out. Anything
+// else, envelope arrays like items and changed included, is always sent so
+// the response shape stays fixed.
+var optionalFields = map[string]bool{"completed_at": true}
+
+// pruneEmpty drops optionalFields members that are null, "", [] or {}, at
+// any depth. Array elements are kept.
+func pruneEmpty(v interface{}) interface{} {
+    switch v := v.(type) {
+    case jsonObject:
+        kept := jsonObject{}
+        for _, m := range v {
+            m.Value = pruneEmpty(m.Value)
+            if !optionalFields[m.Key] || !isEmptyJSON(m.Value) {
+                kept = append(kept, m)
+            }
+        }
+        return kept
+    case []interface{}:
+        for i := range v {
+            v[i] = pruneEmpty(v[i])
+        }
+    }
+    return v
+}
+
+func isEmptyJSON(v interface{}) bool {
+    switch v := v.(type) {
+    case nil:
+        return true
+    case string:
+        return v == ""
+    case []interface{}:
+        return len(v) == 0
+    case jsonObject:
+        return len(v) == 0
+    }
+    return false
+}
+
+// Error codes carried in the JSON error envelope. They are stable, so
+// clients can branch on them instead of matching messages.
+const (
+    CodeBadRequest          = "BAD_REQUEST"
+    CodeBodyTooLarge        = "BODY_TOO_LARGE"
+    CodeForbidden           = "FORBIDDEN"
+    CodeInternal            = "INTERNAL_ERROR"
+    CodeInvalidGzip         = "INVALID_GZIP"
+    CodeInvalidID           = "INVALID_ID"
+    CodeInvalidJSON         = "INVALID_JSON"
+    CodeInvalidPayload      = "INVALID_PAYLOAD"
+    CodeInvalidPatch        = "INVALID_PATCH"
+    CodeInvalidQuery        = "INVALID_QUERY"
+    CodeInvalidTitle        = "INVALID_TITLE"
+    CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+    CodeNotAcceptable       = "NOT_ACCEPTABLE"
+    CodePatchTestFailed     = "PATCH_TEST_FAILED"
+    CodePreconditionFailed  = "PRECONDITION_FAILED"
+    CodeRangeNotSatisfiable = "RANGE_NOT_SATISFIABLE"
+    CodeRateLimited         = "RATE_LIMITED"
+    CodeReadOnly            = "READ_ONLY"
+    CodeRouteNotFound       = "ROUTE_NOT_FOUND"
+    CodeTodoNotFound        = "TODO_NOT_FOUND"
+    CodeTooManyParams       = "TOO_MANY_PARAMS"
+    CodeUnavailable         = "UNAVAILABLE"
+    CodeUnsupportedMedia    = "UNSUPPORTED_MEDIA_TYPE"
+)
+
+// apiError is the body of the {"error": {...}} envelope.
+type apiError struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+    // Offset and Snippet locate an INVALID_JSON syntax error in the body.
+    Offset  *int64 `json:"offset,omitempty"`
+    Snippet string `json:"snippet,omitempty"`
+    // Panic and Stack describe a recovered panic, with -debug-errors only.
+    Panic string `json:"panic,omitempty"`
+    Stack string `json:"stack,omitempty"`
+}
+
+// respondError writes the JSON error envelope with a stable code and a
+// human-readable message.
+func respondError(w http.ResponseWriter, status int, code, message string) {
+    encode(w, jsonCodec{}, map[string]apiError{"error": {Code: code, Message: message}}, status)
+}
+
+// snippetRadius is how many bytes either side of a JSON syntax error the
+// INVALID_JSON snippet shows.
+const snippetRadius = 16
+
+// decodeJSON decodes the request body into v. If that fails it answers the
+// client itself and returns false: a body over -max-body-bytes is 413
+// BODY_TOO_LARGE, syntax errors, including a truncated body, are
+// INVALID_JSON with the byte offset and the text around it, while
+// well-formed JSON of the wrong shape stays INVALID_PAYLOAD.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    body, err := io.ReadAll(r.Body)
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &tooLarge):
+        respondError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+        return false
+    case err != nil:
+        respondError(w, http.StatusBadRequest, CodeInvalidPayload, "invalid payload")
+        return false
+    }
+    err = json.NewDecoder(bytes.NewReader(body)).Decode(v)
+    if err == nil {
+        return true
+    }
+    var syn *json.SyntaxError
+    switch {
+    case errors.As(err, &syn):
+        respondSyntaxError(w, body, syn.Offset, syn.Error())
+    case errors.Is(err, io.ErrUnexpectedEOF):
+        respondSyntaxError(w, body, int64(len(body)), "unexpected end of JSON input")
+    default:
+        respondError(w, http.StatusBadRequest, CodeInvalidPayload, "invalid payload")
+    }
+    return false
+}
+
+func respondSyntaxError(w http.ResponseWriter, body []byte, offset int64, message string) {
+    start, end := offset-snippetRadius, offset+snippetRadius
+    if start < 0 {
+        start = 0
+    }
+    if end > int64(len(body)) {
+        end = int64(len(body))
+    }
+    e := apiError{Code: CodeInvalidJSON, Message: message, Offset: &offset, Snippet: string(body[start:end])}
+    encode(w, jsonCodec{}, map[string]apiError{"error": e}, http.StatusBadRequest)
+}
+
+// isDisconnect reports whether err means the client closed the connection
+// before the response was written.
+func isDisconnect(err error) bool {
+    return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, context.Canceled)
+}
+
+// debugf logs only when -log-level=debug.
+func debugf(format string, args ...interface{}) {
+    if logLevel == "debug" {
+        log.Printf(format, args...)
+    }
+}
+
+// streamNDJSON writes one JSON todo per line as it goes, so large lists are
+// never encoded into a single buffer. todos are copies made by Store.List,
+// so no lock is held while writing and writers are not held up.
+func streamNDJSON(w http.ResponseWriter, todos []*Todo) {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    enc := json.NewEncoder(w)
+    for _, t := range todos {
+        var item interface{} = t
+        if reshaping() {
+            var err error
+            if item, err = reshapeJSON(t); err != nil {
+                log.Printf("Response encoding failed: %v", err)
+                return
+            }
+        }
+        if err := enc.Encode(item); err != nil {
+            if isDisconnect(err) {
+                debugf("response not delivered, client went away: %v", err)
+            } else {
+                log.Printf("Response encoding failed: %v", err)
+            }
+            return
+        }
+    }
+}
+
+// batchResult answers GET /todos?ids=: the todos found, in request order,
+// and the requested ids that do not exist.
+type batchResult struct {
+    Items   []*Todo       `json:"items"`
+    Missing []interface{} `json:"missing"`
+}
+
+// respondBatch serves GET /todos?ids=1,3,5. Duplicate ids are fetched once;
+// more than maxBatchIDs ids, or any malformed one, is a 400.
+func respondBatch(w http.ResponseWriter, r *http.Request, store *Store, list string) {
+    var segs []string
+    seen := make(map[string]bool)
+    for _, seg := range strings.Split(list, ",") {
+        if seg = strings.TrimSpace(seg); !seen[seg] {
+            seen[seg] = true
+            segs = append(segs, seg)
+        }
+    }
+    if len(segs) > maxBatchIDs {
+        respondError(w, http.StatusBadRequest, CodeInvalidQuery, fmt.Sprintf("at most %d ids per request", maxBatchIDs))
+        return
+    }
+    ids := make([]int, len(segs))
+    for i, seg := range segs {
+        id, ok := store.ParseID(seg)
+        if !ok {
+            respondError(w, http.StatusBadRequest, CodeInvalidID, fmt.Sprintf("invalid id %q", seg))
+            return
+        }
+        ids[i] = id
+    }
+    res := batchResult{Items: []*Todo{}, Missing: []interface{}{}}
+    for i, t := range store.GetMany(ids) {
+        if t != nil {
+            res.Items = append(res.Items, t)
+            continue
+        }
+        // Report missing ids in their wire form: numbers unless UUIDs or
+        // prefixed.
+        if idPrefix != "" {
+            res.Missing = append(res.Missing, idPrefix+strings.TrimPrefix(segs[i], idPrefix))
+        } else if n, err := strconv.Atoi(segs[i]); err == nil {
+            res.Missing = append(res.Missing, n)
+        } else {
+            res.Missing = append(res.Missing, segs[i])
+        }
+    }
+    respond(w, r, res, http.StatusOK)
+}
+
+// etagMatch reports whether an If-None-Match header matches etag. It uses
+// the weak comparison of RFC 9110, which ignores the W/ prefix.
+func etagMatch(header, etag string) bool {
+    if header == "" {
+        return false
+    }
+    want := strings.TrimPrefix(etag, "W/")
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag == "*" || strings.TrimPrefix(tag, "W/") == want {
+            return true
+        }
+    }
+    return false
+}
+
+// itemETag is a todo's strong ETag. Versions only grow, so the version
+// alone identifies a state of one todo; the quotes hold no "list-" prefix
+// and no W/, so it never collides with the collection's weak tag.
+func itemETag(t *Todo) string {
+    return fmt.Sprintf(`"v%d"`, t.Version)
+}
+
+// ifMatch reports whether an If-Match header accepts etag, using the strong
+// comparison RFC 9110 requires: weak tags never match.
+func ifMatch(header, etag string) bool {
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag == "*" || tag == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// preferReturn extracts the RFC 7240 "return" preference, "minimal" or
+// "representation", from the Prefer header, or "" if there is none.
+func preferReturn(r *http.Request) string {
+    for _, v := range r.Header.Values("Prefer") {
+        for _, pref := range strings.Split(v, ",") {
+            pref, _, _ = strings.Cut(pref, ";")
+            k, val, _ := strings.Cut(pref, "=")
+            if !strings.EqualFold(strings.TrimSpace(k), "return") {
+                continue
+            }
+            switch val = strings.ToLower(strings.Trim(strings.TrimSpace(val), `"`)); val {
+            case "minimal", "representation":
+                return val
+            }
+        }
+    }
+    return ""
+}
+
+// respondWrite answers a create or update of t with a Location header and,
+// unless the client sent Prefer: return=minimal, the representation data.
+func respondWrite(w http.ResponseWriter, r *http.Request, t *Todo, data interface{}, code int) {
+    w.Header().Set("Location", fmt.Sprintf("/todos/%v", t.view().ID))
+    w.Header().Set("ETag", itemETag(t))
+    switch preferReturn(r) {
+    case "minimal":
+        w.Header().Set("Preference-Applied", "return=minimal")
+        w.WriteHeader(http.StatusNoContent)
+        return
+    case "representation":
+        w.Header().Set("Preference-Applied", "return=representation")
+    }
+    respond(w, r, data, code)
+}
+
+// clientGone logs a request abandoned by its client before the response was
+// built, using nginx's 499 "client closed request" convention.
+func clientGone(r *http.Request, err error) {
+    log.Printf("%s %s 499 client closed request: %v", r.Method, r.URL.Path, err)
+}
+
+// parseID checks the length of an id segment before parsing it and accepts
+// only positive ids.
+func parseID(s string) (int, bool) {
+    if s == "" || len(s) > maxIDLen {
+        return 0, false
+    }
+    id, err := strconv.Atoi(s)
+    if err != nil || id <= 0 {
+        return 0, false
+    }
+    return id, true
+}
+
+// isUUID reports whether s is a lowercase hyphenated UUID.
+func isUUID(s string) bool {
+    if len(s) != 36 {
+        return false
+    }
+    for i, c := range s {
+        switch i {
+        case 8, 13, 18, 23:
+            if c != '-' {
+                return false
+            }
+        default:
+            if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
@@ -0,0 +1,513 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMain(m *testing.M) {
+    log.SetOutput(io.Discard)
+    os.Exit(m.Run())
+}
+
+// newTestHandler builds the main handler for cfg around store, already
+// past startup.
+func newTestHandler(t *testing.T, cfg *Config, store *Store) http.Handler {
+    t.Helper()
+    if err := cfg.Validate(); err != nil {
+        t.Fatalf("invalid config: %v", err)
+    }
+    life := &Lifecycle{retryAfter: cfg.ShutdownRetry}
+    life.ready.Store(true)
+    handler, _ := newHandler(cfg, store, life, &Metrics{}, NewConnLimiter(cfg.MaxConnsPerIP, cfg.TrustedProxies))
+    return handler
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    r.RemoteAddr = "192.0.2.1:1234"
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+    return w
+}
+
+func TestTodosPaths(t *testing.T) {
+    store := NewStore("int")
+    for i := 0; i < 5; i++ {
+        store.Create("todo", false)
+    }
+    h := newTestHandler(t, defaultConfig(), store)
+
+    for _, path := range []string{"/todos", "/todos/"} {
+        w := serve(h, http.MethodGet, path, "")
+        if w.Code != http.StatusOK {
+            t.Fatalf("GET %s: status %d, body %s", path, w.Code, w.Body)
+        }
+        var todos []map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &todos); err != nil {
+            t.Fatalf("GET %s: %v", path, err)
+        }
+        if len(todos) != 5 {
+            t.Errorf("GET %s: got %d todos, want 5", path, len(todos))
+        }
+    }
+
+    w := serve(h, http.MethodGet, "/todos/5", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("GET /todos/5: status %d, body %s", w.Code, w.Body)
+    }
+    var todo map[string]interface{}
+    if err := json.Unmarshal(w.Body.Bytes(), &todo); err != nil {
+        t.Fatalf("GET /todos/5: %v", err)
+    }
+    if todo["id"] != float64(5) {
+        t.Errorf("GET /todos/5: got id %v", todo["id"])
+    }
+
+    if w := serve(h, http.MethodGet, "/todos/6", ""); w.Code != http.StatusNotFound {
+        t.Errorf("GET /todos/6: status %d, want 404", w.Code)
+    }
+}
+
+func TestEmptyListIsArray(t *testing.T) {
+    h := newTestHandler(t, defaultConfig(), NewStore("int"))
+    for _, target := range []string{"/todos", "/todos?with_count=true", "/todos?page=1"} {
+        w := serve(h, http.MethodGet, target, "")
+        if w.Code != http.StatusOK {
+            t.Fatalf("GET %s: status %d, body %s", target, w.Code, w.Body)
+        }
+        if body := w.Body.String(); strings.Contains(body, "null") {
+            t.Errorf("GET %s: got %s, want an empty array, never null", target, body)
+        }
+    }
+    if w := serve(h, http.MethodGet, "/todos", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+        t.Errorf("GET /todos: got %q, want []", w.Body.String())
+    }
+}
+
+func TestOperationalEndpointsBypassLimits(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.WriteRate = 0.001
+    cfg.WriteBurst = 1
+    cfg.RequireHeaders = headerPairs{{"X-Gateway-Auth", "secret"}}
+    h := newTestHandler(t, cfg, NewStore("int"))
+
+    write := func() int {
+        r := httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(`{"title":"t"}`))
+        r.RemoteAddr = "192.0.2.1:1234"
+        r.Header.Set("X-Gateway-Auth", "secret")
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        return w.Code
+    }
+    if code := write(); code != http.StatusCreated {
+        t.Fatalf("first write: status %d, want 201", code)
+    }
+    if code := write(); code != http.StatusTooManyRequests {
+        t.Fatalf("second write: status %d, want 429", code)
+    }
+    if w := serve(h, http.MethodGet, "/todos", ""); w.Code != http.StatusForbidden {
+        t.Fatalf("GET /todos without the required header: status %d, want 403", w.Code)
+    }
+
+    // Same client, bucket empty, no gateway header: probes and the index
+    // still pass.
+    for _, path := range []string{"/healthz", "/readyz", "/metrics", "/"} {
+        if w := serve(h, http.MethodGet, path, ""); w.Code != http.StatusOK {
+            t.Errorf("GET %s: status %d, want 200", path, w.Code)
+        }
+    }
+}
+
+func TestPauseWritesGivesUpOnStalledBody(t *testing.T) {
+    cfg := defaultConfig()
+    store := NewStore("int")
+    life := &Lifecycle{retryAfter: cfg.ShutdownRetry}
+    life.ready.Store(true)
+    h, _ := newHandler(cfg, store, life, &Metrics{}, NewConnLimiter(0, nil))
+
+    // A POST that sent its headers but never finishes its body.
+    body, stall := io.Pipe()
+    done := make(chan struct{})
+    go func() {
+        r := httptest.NewRequest(http.MethodPost, "/todos", body)
+        h.ServeHTTP(httptest.NewRecorder(), r)
+        close(done)
+    }()
+    time.Sleep(50 * time.Millisecond)
+
+    if life.PauseWrites(100 * time.Millisecond) {
+        t.Fatal("PauseWrites succeeded while a write was in flight")
+    }
+    stall.CloseWithError(io.ErrUnexpectedEOF)
+    <-done
+    if w := serve(h, http.MethodPost, "/todos", `{"title":"t"}`); w.Code != http.StatusCreated {
+        t.Errorf("write after the aborted pause: status %d, want 201", w.Code)
+    }
+    if !life.PauseWrites(time.Second) {
+        t.Fatal("PauseWrites failed with no write in flight")
+    }
+    if w := serve(h, http.MethodPost, "/todos", `{"title":"t"}`); w.Code != http.StatusServiceUnavailable {
+        t.Errorf("write while paused: status %d, want 503", w.Code)
+    }
+    life.ResumeWrites()
+}
+
+// TestReadsDoNotRaceWrites runs reads that encode after the store lock is
+// released next to writes to the same todo; run it with -race.
+func TestReadsDoNotRaceWrites(t *testing.T) {
+    store := NewStore("int")
+    store.Create("todo", false)
+    h := newTestHandler(t, defaultConfig(), store)
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 200; i++ {
+            serve(h, http.MethodPut, "/todos/1", fmt.Sprintf(`{"title":"t%d","completed":%t}`, i, i%2 == 0))
+            serve(h, http.MethodPost, "/todos/1/touch", "")
+        }
+    }()
+    for _, target := range []string{"/todos?with_count=true", "/todos/1", "/todos/grouped", "/todos/recent", "/todos/newest", "/todos?ids=1"} {
+        for i := 0; i < 50; i++ {
+            if w := serve(h, http.MethodGet, target, ""); w.Code != http.StatusOK {
+                t.Fatalf("GET %s: status %d", target, w.Code)
+            }
+        }
+    }
+    <-done
+}
+
+func TestReadOnlyServesHead(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.ReadOnly = true
+    store := NewStore("int")
+    store.Create("todo", false)
+    h := newTestHandler(t, cfg, store)
+    for _, path := range []string{"/todos", "/todos/1", "/todos/grouped", "/todos/schema"} {
+        if w := serve(h, http.MethodHead, path, ""); w.Code != http.StatusOK {
+            t.Errorf("HEAD %s: status %d, want 200", path, w.Code)
+        }
+    }
+    if w := serve(h, http.MethodPost, "/todos", `{"title":"t"}`); w.Code != http.StatusMethodNotAllowed {
+        t.Errorf("POST /todos: status %d, want 405", w.Code)
+    }
+}
+
+func TestOmitEmptyKeepsEnvelopes(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.OmitEmpty = true
+    store := NewStore("int")
+    h := newTestHandler(t, cfg, store)
+
+    for target, want := range map[string]string{
+        "/todos?page=1":  `"items":[]`,
+        "/todos/grouped": `"open":[]`,
+    } {
+        if body := serve(h, http.MethodGet, target, "").Body.String(); !strings.Contains(body, want) {
+            t.Errorf("GET %s: got %s, want it to contain %s", target, body, want)
+        }
+    }
+    store.Create("todo", false)
+    w := serve(h, http.MethodPut, "/todos/1", `{"title":"todo"}`)
+    if body := w.Body.String(); !strings.Contains(body, `"changed":[]`) || strings.Contains(body, "completed_at") {
+        t.Errorf("no-op PUT: got %s, want changed:[] and no completed_at", body)
+    }
+}
+
+func TestForceHTTPSLeavesOptionsAsterisk(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.ForceHTTPS = true
+    h := newTestHandler(t, cfg, NewStore("int"))
+    w := serve(h, http.MethodOptions, "*", "")
+    if w.Code != http.StatusNoContent && w.Code != http.StatusOK {
+        t.Fatalf("OPTIONS *: status %d, Location %q", w.Code, w.Header().Get("Location"))
+    }
+    if w.Header().Get("Allow") == "" {
+        t.Error("OPTIONS *: no Allow header")
+    }
+    if w := serve(h, http.MethodGet, "/todos", ""); w.Code != http.StatusMovedPermanently {
+        t.Errorf("GET /todos over plain HTTP: status %d, want 301", w.Code)
+    }
+}
+
+func TestOversizedBodyIs413(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.MaxBodyBytes = 16
+    h := newTestHandler(t, cfg, NewStore("int"))
+    w := serve(h, http.MethodPost, "/todos", `{"title":"`+strings.Repeat("x", 32)+`"}`)
+    if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "BODY_TOO_LARGE") {
+        t.Errorf("oversized POST: status %d, body %s", w.Code, w.Body)
+    }
+    if w := serve(h, http.MethodPost, "/todos", `{"title":`); w.Code != http.StatusBadRequest {
+        t.Errorf("truncated POST: status %d, want 400", w.Code)
+    }
+}
+
+func TestEmptyStoreListETag(t *testing.T) {
+    etag := NewStore("int").ListETag()
+    if strings.Contains(etag, "--") || !strings.HasPrefix(etag, `W/"list-`) || !strings.HasSuffix(etag, `-0"`) {
+        t.Errorf("empty store ETag %s", etag)
+    }
+}
+
+func TestNegotiateHonorsQValues(t *testing.T) {
+    for accept, want := range map[string]string{
+        "":                      "application/json",
+        "*/*":                   "application/json",
+        "application/msgpack":   "application/msgpack",
+        "application/x-msgpack": "application/msgpack",
+        "application/json, application/msgpack;q=0":         "application/json",
+        "application/msgpack;q=0.9, application/json;q=0.5": "application/msgpack",
+        "application/*;q=0.1, application/msgpack":          "application/msgpack",
+        "application/msgpack;q=0, */*":                      "application/json",
+    } {
+        r := httptest.NewRequest(http.MethodGet, "/todos", nil)
+        r.Header.Set("Accept", accept)
+        if got := negotiate(r).ContentType(); got != want {
+            t.Errorf("Accept %q: got %s, want %s", accept, got, want)
+        }
+    }
+}
+
+// decodeMsgpack reads one value in the subset appendMsgpack writes, back
+// into the tree it was built from, and returns the bytes left over.
+func decodeMsgpack(t *testing.T, b []byte) (interface{}, []byte) {
+    t.Helper()
+    c, b := b[0], b[1:]
+    length := func(size int) (int, []byte) {
+        n := 0
+        for _, x := range b[:size] {
+            n = n<<8 | int(x)
+        }
+        return n, b[size:]
+    }
+    signed := func(size int) string {
+        var n int64
+        for _, x := range b[:size] {
+            n = n<<8 | int64(x)
+        }
+        shift := 64 - 8*size
+        return strconv.FormatInt(n<<shift>>shift, 10)
+    }
+    str := func(n int) (interface{}, []byte) { return string(b[:n]), b[n:] }
+    array := func(n int) (interface{}, []byte) {
+        out := []interface{}{}
+        var v interface{}
+        for i := 0; i < n; i++ {
+            v, b = decodeMsgpack(t, b)
+            out = append(out, v)
+        }
+        return out, b
+    }
+    object := func(n int) (interface{}, []byte) {
+        out := jsonObject{}
+        var k, v interface{}
+        for i := 0; i < n; i++ {
+            k, b = decodeMsgpack(t, b)
+            v, b = decodeMsgpack(t, b)
+            out = append(out, jsonMember{k.(string), v})
+        }
+        return out, b
+    }
+    var n int
+    switch {
+    case c <= 0x7f:
+        return json.Number(strconv.Itoa(int(c))), b
+    case c >= 0xe0:
+        return json.Number(strconv.Itoa(int(int8(c)))), b
+    case c&0xe0 == 0xa0:
+        return str(int(c & 0x1f))
+    case c&0xf0 == 0x90:
+        return array(int(c & 0x0f))
+    case c&0xf0 == 0x80:
+        return object(int(c & 0x0f))
+    }
+    switch c {
+    case 0xc0:
+        return nil, b
+    case 0xc2, 0xc3:
+        return c == 0xc3, b
+    case 0xcc, 0xcd, 0xce, 0xcf:
+        size := 1 << (c - 0xcc)
+        var u uint64
+        for _, x := range b[:size] {
+            u = u<<8 | uint64(x)
+        }
+        return json.Number(strconv.FormatUint(u, 10)), b[size:]
+    case 0xd0, 0xd1, 0xd2, 0xd3:
+        size := 1 << (c - 0xd0)
+        return json.Number(signed(size)), b[size:]
+    case 0xcb:
+        bits := uint64(0)
+        for _, x := range b[:8] {
+            bits = bits<<8 | uint64(x)
+        }
+        return json.Number(strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64)), b[8:]
+    case 0xd9:
+        n, b = length(1)
+        return str(n)
+    case 0xda:
+        n, b = length(2)
+        return str(n)
+    case 0xdb:
+        n, b = length(4)
+        return str(n)
+    case 0xdc:
+        n, b = length(2)
+        return array(n)
+    case 0xdd:
+        n, b = length(4)
+        return array(n)
+    case 0xde:
+        n, b = length(2)
+        return object(n)
+    case 0xdf:
+        n, b = length(4)
+        return object(n)
+    }
+    t.Fatalf("unexpected msgpack byte %#x", c)
+    return nil, nil
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+    list := func(n int) []interface{} {
+        out := make([]interface{}, n)
+        for i := range out {
+            out[i] = json.Number(strconv.Itoa(i))
+        }
+        return out
+    }
+    object := func(n int) jsonObject {
+        out := jsonObject{}
+        for i := 0; i < n; i++ {
+            out = append(out, jsonMember{fmt.Sprintf("k%02d", i), true})
+        }
+        return out
+    }
+    for _, tc := range []struct {
+        name string
+        v    interface{}
+        head []byte
+    }{
+        {"nil", nil, []byte{0xc0}},
+        {"false", false, []byte{0xc2}},
+        {"fixstr 31", strings.Repeat("a", 31), []byte{0xbf}},
+        {"str8 32", strings.Repeat("a", 32), []byte{0xd9, 32}},
+        {"str8 255", strings.Repeat("a", 255), []byte{0xd9, 255}},
+        {"str16 256", strings.Repeat("a", 256), []byte{0xda, 1, 0}},
+        {"fixarray 15", list(15), []byte{0x9f}},
+        {"array16 16", list(16), []byte{0xdc, 0, 16}},
+        {"array16 65535", list(65535), []byte{0xdc, 0xff, 0xff}},
+        {"array32 65536", list(65536), []byte{0xdd, 0, 1, 0, 0}},
+        {"fixmap 15", object(15), []byte{0x8f}},
+        {"map16 16", object(16), []byte{0xde, 0, 16}},
+        {"positive fixint 127", json.Number("127"), []byte{0x7f}},
+        {"uint8 128", json.Number("128"), []byte{0xcc, 0x80}},
+        {"uint16 256", json.Number("256"), []byte{0xcd, 1, 0}},
+        {"uint64 max int64", json.Number("9223372036854775807"), []byte{0xcf}},
+        {"negative fixint -1", json.Number("-1"), []byte{0xff}},
+        {"negative fixint -32", json.Number("-32"), []byte{0xe0}},
+        {"int8 -33", json.Number("-33"), []byte{0xd0, 0xdf}},
+        {"int8 -128", json.Number("-128"), []byte{0xd0, 0x80}},
+        {"int16 -129", json.Number("-129"), []byte{0xd1, 0xff, 0x7f}},
+        {"int32 -32769", json.Number("-32769"), []byte{0xd2}},
+        {"int64 min", json.Number("-9223372036854775808"), []byte{0xd3}},
+        {"float", json.Number("1.5"), []byte{0xcb}},
+    } {
+        b, err := appendMsgpack(nil, tc.v)
+        if err != nil {
+            t.Fatalf("%s: %v", tc.name, err)
+        }
+        if !bytes.HasPrefix(b, tc.head) {
+            t.Errorf("%s: encoded as % x..., want prefix % x", tc.name, b[:min(len(b), 5)], tc.head)
+        }
+        got, rest := decodeMsgpack(t, b)
+        if len(rest) != 0 {
+            t.Errorf("%s: %d trailing bytes", tc.name, len(rest))
+        }
+        if !reflect.DeepEqual(got, tc.v) {
+            t.Errorf("%s: round trip gave %v", tc.name, got)
+        }
+    }
+}
+
+func TestPatch(t *testing.T) {
+    for _, tc := range []struct {
+        name      string
+        patch     string
+        code      int
+        errCode   string
+        title     string
+        completed bool
+        version   int
+    }{
+        {"replace", `[{"op":"replace","path":"/title","value":"new"}]`, http.StatusOK, "", "new", false, 2},
+        {"test then replace", `[{"op":"test","path":"/title","value":"old"},{"op":"replace","path":"/completed","value":true}]`, http.StatusOK, "", "old", true, 2},
+        {"failing test", `[{"op":"test","path":"/title","value":"other"},{"op":"replace","path":"/title","value":"new"}]`, http.StatusConflict, "PATCH_TEST_FAILED", "old", false, 1},
+        {"read-only id", `[{"op":"replace","path":"/id","value":7}]`, http.StatusUnprocessableEntity, "INVALID_PATCH", "old", false, 1},
+        {"unsupported op", `[{"op":"move","from":"/title","path":"/title"}]`, http.StatusUnprocessableEntity, "INVALID_PATCH", "old", false, 1},
+        {"unknown path", `[{"op":"replace","path":"/owner","value":"me"}]`, http.StatusUnprocessableEntity, "INVALID_PATCH", "old", false, 1},
+        {"test only", `[{"op":"test","path":"/version","value":1}]`, http.StatusOK, "", "old", false, 1},
+        {"camelCase paths", `[{"op":"test","path":"/completedAt","value":null},{"op":"replace","path":"/completed","value":true}]`, http.StatusOK, "", "old", true, 2},
+        {"camelCase read-only", `[{"op":"replace","path":"/createdAt","value":"2020-01-01T00:00:00Z"}]`, http.StatusUnprocessableEntity, "INVALID_PATCH", "old", false, 1},
+        {"malformed", `[{"op":`, http.StatusBadRequest, "INVALID_JSON", "old", false, 1},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            store := NewStore("int")
+            store.Create("old", false)
+            h := newTestHandler(t, defaultConfig(), store)
+            r := httptest.NewRequest(http.MethodPatch, "/todos/1", strings.NewReader(tc.patch))
+            r.Header.Set("Content-Type", "application/json-patch+json")
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+            if w.Code != tc.code {
+                t.Fatalf("status %d, want %d: %s", w.Code, tc.code, w.Body)
+            }
+            if tc.errCode != "" && !strings.Contains(w.Body.String(), `"code":"`+tc.errCode+`"`) {
+                t.Errorf("body %s, want code %s", w.Body, tc.errCode)
+            }
+            got, _ := store.Get(1)
+            if got.Title != tc.title || got.Completed != tc.completed || got.Version != tc.version {
+                t.Errorf("todo is %q completed=%t version=%d, want %q completed=%t version=%d",
+                    got.Title, got.Completed, got.Version, tc.title, tc.completed, tc.version)
+            }
+        })
+    }
+
+    h := newTestHandler(t, defaultConfig(), NewStore("int"))
+    if w := serve(h, http.MethodPatch, "/todos/1", `[]`); w.Code != http.StatusUnsupportedMediaType {
+        t.Errorf("PATCH without the JSON Patch media type: status %d, want 415", w.Code)
+    }
+}
+
+func TestHandlerAppliesOutputSettings(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.IDPrefix = "todo_"
+    cfg.JSONNaming = "camel"
+    store := NewStore("int")
+    store.Create("todo", false)
+    h := newTestHandler(t, cfg, store)
+    body := serve(h, http.MethodGet, "/todos/todo_1", "").Body.String()
+    if !strings.Contains(body, `"id":"todo_1"`) || !strings.Contains(body, `"createdAt"`) {
+        t.Errorf("GET /todos/todo_1 with -id-prefix and -json-naming=camel: got %s", body)
+    }
+
+    // A handler built from the defaults puts them back.
+    h = newTestHandler(t, defaultConfig(), store)
+    if body := serve(h, http.MethodGet, "/todos/1", "").Body.String(); !strings.Contains(body, `"id":1,`) {
+        t.Errorf("GET /todos/1 with defaults: got %s", body)
+    }
+}